@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+Scores for pairwise alignment. A gap of length k costs gapOpen + k *
+gapExtend. band is how far either side of the diagonal we look (0 means
+look everywhere, which is only OK for short sequences since it needs
+len(a)*len(b) bytes).
+*/
+type AlignParams struct {
+	match, mismatch    int
+	gapOpen, gapExtend int
+	band               int
+}
+
+// Much like EMBOSS needle's defaults for DNA
+var DefaultAlignParams = AlignParams{5, -4, 10, 1, 500}
+
+const alignMinusInf = -(1 << 30)
+
+// States of the aligner: which of a and b the last column used
+const (
+	alignBoth = iota // a[i] against b[j]
+	alignGapB        // a[i] against a gap
+	alignGapA        // b[j] against a gap
+)
+
+func (p *AlignParams) score(a, b byte) int {
+	switch {
+	case !isUnambiguous(a) || !isUnambiguous(b):
+		return 0
+	case a == b:
+		return p.match
+	}
+	return p.mismatch
+}
+
+func max3(a, b, c int) (int, int) {
+	switch {
+	case a >= b && a >= c:
+		return a, alignBoth
+	case b >= c:
+		return b, alignGapB
+	}
+	return c, alignGapA
+}
+
+var errAlignBand = errors.New("Alignment went outside the band")
+
+/*
+Global alignment with affine gaps (Gotoh), only looking at the cells within
+width of the line from (0, 0) to (len(a), len(b)). Returns errAlignBand if
+the best path we found touched the edge of the band, since then there may
+be a better one outside it.
+
+We only keep one row of scores for each state, but we need a traceback byte
+per cell, which has 2 bits for where each of the 3 states came from.
+*/
+func alignBanded(a, b []byte, p *AlignParams, width int) ([]byte, []byte,
+	error) {
+	n, m := len(a), len(b)
+
+	// The range of j we look at for each i
+	lo := make([]int, n+1)
+	hi := make([]int, n+1)
+	for i := 0; i <= n; i++ {
+		centre := 0
+		if n > 0 {
+			centre = i * m / n
+		}
+		lo[i], hi[i] = centre-width, centre+width
+		if lo[i] < 0 {
+			lo[i] = 0
+		}
+		if hi[i] > m {
+			hi[i] = m
+		}
+	}
+
+	// If b is much longer than a the bands of neighbouring rows might not
+	// overlap, and then there'd be no way through.
+	for i := 0; i < n; i++ {
+		if hi[i] < lo[i+1] {
+			hi[i] = lo[i+1]
+		}
+	}
+
+	trace := make([][]byte, n+1)
+	prev := [3][]int{make([]int, m+2), make([]int, m+2), make([]int, m+2)}
+	cur := [3][]int{make([]int, m+2), make([]int, m+2), make([]int, m+2)}
+	for s := 0; s < 3; s++ {
+		for j := range prev[s] {
+			prev[s][j], cur[s][j] = alignMinusInf, alignMinusInf
+		}
+	}
+
+	for i := 0; i <= n; i++ {
+		trace[i] = make([]byte, hi[i]-lo[i]+1)
+
+		// Make sure nothing left over from earlier rows is used
+		for s := 0; s < 3; s++ {
+			if lo[i] > 0 {
+				cur[s][lo[i]-1] = alignMinusInf
+			}
+			cur[s][hi[i]+1] = alignMinusInf
+		}
+
+		for j := lo[i]; j <= hi[i]; j++ {
+			var t byte
+			both, gapB, gapA := alignMinusInf, alignMinusInf, alignMinusInf
+
+			switch {
+			case i == 0 && j == 0:
+				both = 0
+			case i == 0:
+				gapA = -(p.gapOpen + j*p.gapExtend)
+				t |= alignGapA << 4
+			case j == 0:
+				gapB = -(p.gapOpen + i*p.gapExtend)
+				t |= alignGapB << 2
+			default:
+				var from int
+				both, from = max3(prev[alignBoth][j-1], prev[alignGapB][j-1],
+					prev[alignGapA][j-1])
+				both += p.score(a[i-1], b[j-1])
+				t |= byte(from)
+
+				gapB, from = max3(prev[alignBoth][j]-p.gapOpen,
+					prev[alignGapB][j], prev[alignGapA][j]-p.gapOpen)
+				gapB -= p.gapExtend
+				t |= byte(from) << 2
+
+				gapA, from = max3(cur[alignBoth][j-1]-p.gapOpen,
+					cur[alignGapB][j-1]-p.gapOpen, cur[alignGapA][j-1])
+				gapA -= p.gapExtend
+				t |= byte(from) << 4
+			}
+
+			cur[alignBoth][j], cur[alignGapB][j], cur[alignGapA][j] =
+				both, gapB, gapA
+			trace[i][j-lo[i]] = t
+		}
+		prev, cur = cur, prev
+	}
+
+	_, state := max3(prev[alignBoth][m], prev[alignGapB][m],
+		prev[alignGapA][m])
+
+	// Walk back from the end, building the rows backwards
+	retA := make([]byte, 0, n+m)
+	retB := make([]byte, 0, n+m)
+	for i, j := n, m; i > 0 || j > 0; {
+		if (j == lo[i] && lo[i] > 0) || (j == hi[i] && hi[i] < m) {
+			return nil, nil, errAlignBand
+		}
+
+		t := trace[i][j-lo[i]]
+		switch state {
+		case alignBoth:
+			state = int(t & 3)
+			i, j = i-1, j-1
+			retA, retB = append(retA, a[i]), append(retB, b[j])
+		case alignGapB:
+			state = int(t>>2) & 3
+			i--
+			retA, retB = append(retA, a[i]), append(retB, '-')
+		case alignGapA:
+			state = int(t>>4) & 3
+			j--
+			retA, retB = append(retA, '-'), append(retB, b[j])
+		}
+	}
+
+	for i, j := 0, len(retA)-1; i < j; i, j = i+1, j-1 {
+		retA[i], retA[j] = retA[j], retA[i]
+		retB[i], retB[j] = retB[j], retB[i]
+	}
+	return retA, retB, nil
+}
+
+/*
+Align a and b (which shouldn't have any gaps in them) and return the two
+aligned rows. If the best alignment goes too far from the diagonal for the
+band we keep doubling it until it fits.
+*/
+func Align(a, b []byte, p AlignParams) ([]byte, []byte) {
+	width := p.band
+	for {
+		full := width <= 0 || (width >= len(a) && width >= len(b))
+		if full {
+			width = len(a) + len(b)
+		}
+
+		retA, retB, err := alignBanded(a, b, &p, width)
+		if err == nil || full {
+			return retA, retB
+		}
+		width *= 2
+	}
+}
+
+/*
+Align the first genome in b with the first genome in a, and return them as
+an alignment with a's ORFs.
+*/
+func AlignGenomes(a, b *Genomes, p AlignParams) *Genomes {
+	ret := NewGenomes(nil, 2)
+	ret.nts[0], ret.nts[1] = Align(ungapped(a.nts[0]), ungapped(b.nts[0]), p)
+	ret.names[0], ret.names[1] = a.names[0], b.names[0]
+
+	orfs := a.Liftover(0).UnprojectOrfs(a.orfs)
+	ret.orfs = ret.Liftover(0).ProjectOrfs(orfs)
+	return ret
+}
+
+/*
+Load the alignment of WH1 with the named relative from WH1-<name>.fasta (or
+.aln, .sto or .phy, which can be in any format we can read). If none of
+those are there we align them ourselves (which takes a little while) and
+save the alignment there so it's quicker next time. If codonAware we then
+realign the ORFs codon by codon (see CodonAlign), and the ORFs of what we
+return are in its columns.
+*/
+func LoadWH1Alignment(name string, codonAware bool) (*Genomes, error) {
+	ret, err := loadWH1Alignment(name)
+	if err != nil || !codonAware {
+		return ret, err
+	}
+	return CodonAlign(ret, DefaultCodonAlignParams), nil
+}
+
+func loadWH1Alignment(name string) (*Genomes, error) {
+	fname := fmt.Sprintf("WH1-%s.fasta", name)
+	existing := findInput("WH1-"+name, ".fasta", ".aln", ".sto", ".phy")
+	if existing != "" {
+		return LoadGenomes(existing, "WH1.orfs")
+	}
+
+	wh1, err := LoadGenomes("WH1.fasta", "WH1.orfs")
+	if err != nil {
+		return nil, err
+	}
+
+	relatives, err := loadGenomes([]string{name})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Aligning WH1 with %s...\n", name)
+	ret := AlignGenomes(wh1, relatives[0], DefaultAlignParams)
+
+	if err := ret.SaveAlignment(fname); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Wrote %s\n", fname)
+	return ret, nil
+}
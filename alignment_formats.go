@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The alignment file formats we can read and write
+type AlignmentFormat int
+
+const (
+	FASTA AlignmentFormat = iota
+	CLUSTAL
+	STOCKHOLM
+	PHYLIP
+)
+
+/*
+Guess the format from the first line that isn't blank. Anything we don't
+recognize is treated as FASTA so that the FASTA reader can complain about
+it.
+*/
+func detectAlignmentFormat(fp *bufio.Reader) AlignmentFormat {
+	// If the file is shorter than this we'll get what there is
+	head, _ := fp.Peek(4096)
+
+	var first string
+	for _, line := range strings.Split(string(head), "\n") {
+		first = strings.TrimSpace(line)
+		if first != "" {
+			break
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(first, "CLUSTAL"),
+		strings.HasPrefix(first, "MUSCLE"):
+		return CLUSTAL
+	case strings.HasPrefix(first, "# STOCKHOLM"):
+		return STOCKHOLM
+	}
+
+	fields := strings.Fields(first)
+	if len(fields) == 2 {
+		_, err1 := strconv.Atoi(fields[0])
+		_, err2 := strconv.Atoi(fields[1])
+		if err1 == nil && err2 == nil {
+			return PHYLIP
+		}
+	}
+	return FASTA
+}
+
+// Work out which format to write from the file name (ignoring any .gz)
+func alignmentFormatFromName(fname string) AlignmentFormat {
+	fname = strings.TrimSuffix(strings.TrimSuffix(fname, ".gz"), ".bgz")
+	switch filepath.Ext(fname) {
+	case ".aln", ".clustal":
+		return CLUSTAL
+	case ".sto", ".stk", ".stockholm":
+		return STOCKHOLM
+	case ".phy", ".phylip":
+		return PHYLIP
+	}
+	return FASTA
+}
+
+/*
+The rows of an alignment as we read them. Clustal, Stockholm and
+interleaved PHYLIP files give each row in pieces, so we look rows up by name
+and add to them.
+*/
+type alignmentRows struct {
+	names []string
+	nts   [][]byte
+	lines []int // Where each row first appeared, for errors
+	index map[string]int
+}
+
+func newAlignmentRows() *alignmentRows {
+	return &alignmentRows{index: make(map[string]int)}
+}
+
+func (a *alignmentRows) add(name string, nts []byte, line int) {
+	i, there := a.index[name]
+	if !there {
+		i = len(a.names)
+		a.index[name] = i
+		a.names = append(a.names, name)
+		a.nts = append(a.nts, make([]byte, 0))
+		a.lines = append(a.lines, line)
+	}
+	a.nts[i] = append(a.nts[i], nts...)
+}
+
+/*
+Turn a piece of aligned sequence from one of the other formats into our
+nts, which means uppercase with '-' for gaps. Stockholm uses '.' for gaps
+too and PHYLIP uses '?' for unknown.
+*/
+func alignedNts(fname string, line int, s string) ([]byte, error) {
+	ret := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		nt := s[i]
+		switch nt {
+		case ' ', '\t':
+			continue
+		case '.', '~':
+			nt = '-'
+		case '?':
+			nt = 'N'
+		}
+		if nt >= 'a' && nt <= 'z' {
+			nt -= 'a' - 'A'
+		}
+		if !isValidNt(nt) {
+			return nil, loadError(fname, line, "Bad nucleotide '%c'", s[i])
+		}
+		ret = append(ret, nt)
+	}
+	return ret, nil
+}
+
+// Call f on each line (without the line ending) with its line number
+func forEachLine(fp *bufio.Reader, fname string,
+	f func(line string, lineNum int) error) error {
+	lineNum := 0
+	for {
+		line, err := fp.ReadString('\n')
+		switch err {
+		case io.EOF:
+			if line == "" {
+				return nil
+			}
+		case nil:
+			break
+		default:
+			return &LoadError{fname, lineNum, err}
+		}
+		lineNum++
+
+		if err := f(strings.TrimRight(line, "\r\n"), lineNum); err != nil {
+			return err
+		}
+	}
+}
+
+func readFasta(fp *bufio.Reader, fname string) (*alignmentRows, error) {
+	ret := newAlignmentRows()
+	r := NewFastaReader(fp, fname)
+	for {
+		name, nts, err := r.Next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// FASTA rows come in one piece so they don't get looked up by name,
+		// which means duplicate names are OK.
+		ret.names = append(ret.names, name)
+		ret.nts = append(ret.nts, nts)
+		ret.lines = append(ret.lines, r.line)
+	}
+}
+
+/*
+Clustal files are a header line and then blocks of "name sequence [count]"
+lines, each block followed by a line of conservation markers (which starts
+with a space).
+*/
+func readClustal(fp *bufio.Reader, fname string) (*alignmentRows, error) {
+	ret := newAlignmentRows()
+	err := forEachLine(fp, fname, func(line string, lineNum int) error {
+		if line == "" || line[0] == ' ' || line[0] == '\t' ||
+			strings.HasPrefix(line, "CLUSTAL") ||
+			strings.HasPrefix(line, "MUSCLE") {
+			return nil
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return loadError(fname, lineNum,
+				"Expected name, sequence and an optional count")
+		}
+		nts, err := alignedNts(fname, lineNum, fields[1])
+		if err != nil {
+			return err
+		}
+		ret.add(fields[0], nts, lineNum)
+		return nil
+	})
+	return ret, err
+}
+
+/*
+Stockholm files are like Clustal but with "#=" annotation lines, which we
+ignore, and // at the end. Only the first alignment in the file is read.
+*/
+func readStockholm(fp *bufio.Reader, fname string) (*alignmentRows, error) {
+	ret := newAlignmentRows()
+	done := false
+	err := forEachLine(fp, fname, func(line string, lineNum int) error {
+		line = strings.TrimSpace(line)
+		if done || line == "" || strings.HasPrefix(line, "#") {
+			return nil
+		}
+		if line == "//" {
+			done = true
+			return nil
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return loadError(fname, lineNum, "Expected name and sequence")
+		}
+		nts, err := alignedNts(fname, lineNum, fields[1])
+		if err != nil {
+			return err
+		}
+		ret.add(fields[0], nts, lineNum)
+		return nil
+	})
+	return ret, err
+}
+
+/*
+PHYLIP files start with the number of rows and columns. We read the relaxed
+form where the name is separated from the sequence by whitespace rather than
+being exactly 10 characters. A sequence can be wrapped onto more lines in
+one of two ways: in the sequential form each sequence carries on over the
+lines after it until it's as long as the header says, and in the interleaved
+form the first block has a name on each line and the blocks after that carry
+on the rows in the same order.
+*/
+func readPhylip(fp *bufio.Reader, fname string) (*alignmentRows, error) {
+	var numRows, numCols int
+	lines := make([][]string, 0)
+	lineNums := make([]int, 0)
+
+	err := forEachLine(fp, fname, func(line string, lineNum int) error {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return nil
+		}
+
+		if numRows == 0 {
+			numRows, _ = strconv.Atoi(fields[0])
+			if len(fields) > 1 {
+				numCols, _ = strconv.Atoi(fields[1])
+			}
+			if numRows < 1 {
+				return loadError(fname, lineNum, "No sequences")
+			}
+			return nil
+		}
+
+		lines = append(lines, fields)
+		lineNums = append(lineNums, lineNum)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// It's sequential if the first sequence gets to the right length over
+	// k lines with no names on the ones after the first, and there are k
+	// lines for every row. If every sequence is on one line it's both.
+	sequential := false
+	if len(lines) > 0 && len(lines[0]) >= 2 {
+		first, _ := alignedNts(fname, lineNums[0],
+			strings.Join(lines[0][1:], ""))
+		n, k := len(first), 1
+		for ; n < numCols && k < len(lines); k++ {
+			nts, err := alignedNts(fname, lineNums[k],
+				strings.Join(lines[k], ""))
+			if err != nil {
+				break
+			}
+			n += len(nts)
+		}
+		sequential = n == numCols && len(lines) == numRows*k
+	}
+
+	ret := newAlignmentRows()
+	for i, fields := range lines {
+		lineNum := lineNums[i]
+
+		// A new row starts here if we've got all of the previous one
+		newRow := len(ret.names) < numRows
+		if sequential && len(ret.names) > 0 {
+			newRow = len(ret.nts[len(ret.nts)-1]) >= numCols
+		}
+
+		if newRow {
+			if len(fields) < 2 {
+				return nil, loadError(fname, lineNum,
+					"Expected name and sequence")
+			}
+			nts, err := alignedNts(fname, lineNum,
+				strings.Join(fields[1:], ""))
+			if err != nil {
+				return nil, err
+			}
+			ret.add(fields[0], nts, lineNum)
+			continue
+		}
+
+		nts, err := alignedNts(fname, lineNum, strings.Join(fields, ""))
+		if err != nil {
+			return nil, err
+		}
+		row := len(ret.names) - 1
+		if !sequential {
+			row = (i - numRows) % numRows
+		}
+		ret.nts[row] = append(ret.nts[row], nts...)
+	}
+
+	if len(ret.names) != numRows {
+		return nil, loadError(fname, 0, "Expected %d sequences but got %d",
+			numRows, len(ret.names))
+	}
+	for i, nts := range ret.nts {
+		if len(nts) != numCols {
+			return nil, loadError(fname, ret.lines[i],
+				"%s is length %d but the header says %d", ret.names[i],
+				len(nts), numCols)
+		}
+	}
+	return ret, nil
+}
+
+// Read an alignment in any of the formats we know about
+func readAlignment(fp *bufio.Reader, fname string) (*alignmentRows, error) {
+	switch detectAlignmentFormat(fp) {
+	case CLUSTAL:
+		return readClustal(fp, fname)
+	case STOCKHOLM:
+		return readStockholm(fp, fname)
+	case PHYLIP:
+		return readPhylip(fp, fname)
+	}
+	return readFasta(fp, fname)
+}
+
+// The width of the name column so that the sequences line up
+func (g *Genomes) nameWidth() int {
+	ret := 0
+	for _, name := range g.names {
+		if len(name) > ret {
+			ret = len(name)
+		}
+	}
+	return ret
+}
+
+/*
+Clustal marks the columns where every row has the same nt with a '*'. The
+running count at the end of each line is how many nts (not gaps) that row
+has had so far.
+*/
+func (g *Genomes) writeClustal(w io.Writer) {
+	const width = 60
+	fmt.Fprintf(w, "CLUSTAL W multiple sequence alignment\n\n\n")
+
+	nameWidth := g.nameWidth() + 6
+	counts := make([]int, g.NumGenomes())
+
+	for start := 0; start < g.Length(); start += width {
+		end := start + width
+		if end > g.Length() {
+			end = g.Length()
+		}
+
+		for i := 0; i < g.NumGenomes(); i++ {
+			block := g.nts[i][start:end]
+			counts[i] += len(block) - bytes.Count(block, []byte{'-'})
+			fmt.Fprintf(w, "%-*s%s %d\n", nameWidth, g.names[i], block,
+				counts[i])
+		}
+
+		conservation := make([]byte, end-start)
+		for j := start; j < end; j++ {
+			conservation[j-start] = '*'
+			for i := 0; i < g.NumGenomes(); i++ {
+				if g.nts[i][j] == '-' || g.nts[i][j] != g.nts[0][j] {
+					conservation[j-start] = ' '
+					break
+				}
+			}
+		}
+		fmt.Fprintf(w, "%-*s%s\n\n", nameWidth, "", conservation)
+	}
+}
+
+func (g *Genomes) writeStockholm(w io.Writer) {
+	fmt.Fprintln(w, "# STOCKHOLM 1.0")
+	nameWidth := g.nameWidth() + 1
+	for i := 0; i < g.NumGenomes(); i++ {
+		fmt.Fprintf(w, "%-*s%s\n", nameWidth, g.names[i], g.nts[i])
+	}
+	fmt.Fprintln(w, "//")
+}
+
+// We write sequential, relaxed PHYLIP with each row on one line
+func (g *Genomes) writePhylip(w io.Writer) {
+	fmt.Fprintf(w, "%d %d\n", g.NumGenomes(), g.Length())
+	nameWidth := g.nameWidth() + 2
+	for i := 0; i < g.NumGenomes(); i++ {
+		fmt.Fprintf(w, "%-*s%s\n", nameWidth, g.names[i], g.nts[i])
+	}
+}
+
+/*
+Save all the genomes as an alignment in the format that goes with fname's
+extension: .aln for Clustal, .sto for Stockholm, .phy for PHYLIP and
+anything else for FASTA.
+*/
+func (g *Genomes) SaveAlignment(fname string) error {
+	format := alignmentFormatFromName(fname)
+	if format == FASTA {
+		return g.SaveAll(fname, 60, nil)
+	}
+
+	fd, err := createOutput(fname)
+	if err != nil {
+		return err
+	}
+
+	fp := bufio.NewWriter(fd)
+	switch format {
+	case CLUSTAL:
+		g.writeClustal(fp)
+	case STOCKHOLM:
+		g.writeStockholm(fp)
+	case PHYLIP:
+		g.writePhylip(fp)
+	}
+
+	err = fp.Flush()
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
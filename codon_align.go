@@ -0,0 +1,406 @@
+package main
+
+import (
+	"sort"
+)
+
+/*
+Scores for codon-aware alignment. Codons are scored with BLOSUM62 on their
+amino acids, scaled up by 4 so that we can add 1 for each nt that's the same
+(so that given a choice we line up the codon that's identical rather than
+one that's just synonymous). Gaps are whole codons, costing gapOpen + k *
+gapExtend for k codons. Anything that breaks the reading frame costs
+frameshift for each nt that's out of place. band is in nts of b either side
+of the diagonal.
+*/
+type CodonAlignParams struct {
+	gapOpen, gapExtend int
+	frameshift         int
+	band               int
+}
+
+var DefaultCodonAlignParams = CodonAlignParams{44, 4, 80, 300}
+
+// The extra state we have on top of the nt aligner's
+const alignFrameshift = 3
+
+// The ways to get to the frameshift state
+const (
+	frameshiftB   = iota // An extra nt in b
+	frameshiftOne        // A codon of a against 1 nt of b
+	frameshiftTwo        // A codon of a against 2 nts of b
+)
+
+/*
+A band of the DP table for one codon of a: the scores for each of the 4
+states for j in [lo, hi], where j is how many nts of b we've used.
+*/
+type codonAlignRow struct {
+	lo, hi int
+	scores [4][]int
+}
+
+func (r *codonAlignRow) get(state, j int) int {
+	if j < r.lo || j > r.hi {
+		return alignMinusInf
+	}
+	return r.scores[state][j-r.lo]
+}
+
+func (r *codonAlignRow) best(j int) (int, int) {
+	ret, state := alignMinusInf, alignBoth
+	for s := 0; s < 4; s++ {
+		if v := r.get(s, j); v > ret {
+			ret, state = v, s
+		}
+	}
+	return ret, state
+}
+
+// The best of the states at j, where getting there from anything other than
+// from is penalized by open.
+func (r *codonAlignRow) bestFrom(j, from, open int) (int, int) {
+	ret, state := alignMinusInf, alignBoth
+	for s := 0; s < 4; s++ {
+		v := r.get(s, j)
+		if s != from {
+			v -= open
+		}
+		if v > ret {
+			ret, state = v, s
+		}
+	}
+	return ret, state
+}
+
+/*
+Align a, which must be a whole number of codons, with b, which could be
+anything. Both are read 5' to 3' and translated with code. Returns the two
+aligned rows, which have gaps of whole codons except where b is out of frame
+with a. Like alignBanded returns errAlignBand if the best path touched the
+edge of the band.
+*/
+func alignCodonsBanded(a, b []byte, code *GeneticCode, p *CodonAlignParams,
+	width int) ([]byte, []byte, error) {
+	n, m := len(a)/3, len(b)
+
+	lo := make([]int, n+1)
+	hi := make([]int, n+1)
+	for i := 0; i <= n; i++ {
+		centre := i * m / n
+		lo[i], hi[i] = centre-width, centre+width
+		if lo[i] < 0 {
+			lo[i] = 0
+		}
+		if hi[i] > m {
+			hi[i] = m
+		}
+	}
+	for i := 0; i < n; i++ {
+		if hi[i] < lo[i+1] {
+			hi[i] = lo[i+1]
+		}
+	}
+
+	aAas := make([]byte, n)
+	for i := 0; i < n; i++ {
+		aAas[i] = code.Translate(a[i*3 : i*3+3])
+	}
+
+	score := func(i, j int) int {
+		codon := b[j-3 : j]
+		ret := 4 * Blosum62(aAas[i-1], code.Translate(codon))
+		for k := 0; k < 3; k++ {
+			if a[(i-1)*3+k] == codon[k] {
+				ret++
+			}
+		}
+		return ret
+	}
+
+	newRow := func(i int) *codonAlignRow {
+		r := codonAlignRow{lo: lo[i], hi: hi[i]}
+		for s := 0; s < 4; s++ {
+			r.scores[s] = make([]int, hi[i]-lo[i]+1)
+		}
+		return &r
+	}
+
+	/*
+		2 bits each for where the both, gapB and gapA states came from, then 2
+		for where the frameshift state came from and 2 for how.
+	*/
+	trace := make([][]uint16, n+1)
+	var prev *codonAlignRow
+
+	for i := 0; i <= n; i++ {
+		cur := newRow(i)
+		trace[i] = make([]uint16, hi[i]-lo[i]+1)
+
+		for j := lo[i]; j <= hi[i]; j++ {
+			var t uint16
+			var from int
+			both, gapB, gapA, fs := alignMinusInf, alignMinusInf,
+				alignMinusInf, alignMinusInf
+
+			if i == 0 && j == 0 {
+				both = 0
+			}
+
+			if i > 0 && j >= 3 {
+				both, from = prev.best(j - 3)
+				both += score(i, j)
+				t |= uint16(from)
+			}
+
+			if i > 0 {
+				gapB, from = prev.bestFrom(j, alignGapB, p.gapOpen)
+				gapB -= p.gapExtend
+				t |= uint16(from) << 2
+			}
+
+			if j >= 3 {
+				gapA, from = cur.bestFrom(j-3, alignGapA, p.gapOpen)
+				gapA -= p.gapExtend
+				t |= uint16(from) << 4
+			}
+
+			if j >= 1 {
+				v, from := cur.best(j - 1)
+				fs, t = v-p.frameshift, t|uint16(from)<<6|frameshiftB<<8
+				if i > 0 {
+					for k, how := range []int{frameshiftOne, frameshiftTwo} {
+						if j < k+1 {
+							break
+						}
+						v, from := prev.best(j - k - 1)
+						if v-p.frameshift > fs {
+							fs = v - p.frameshift
+							t = t&0x3f | uint16(from)<<6 | uint16(how)<<8
+						}
+					}
+				}
+			}
+
+			cur.scores[alignBoth][j-lo[i]] = both
+			cur.scores[alignGapB][j-lo[i]] = gapB
+			cur.scores[alignGapA][j-lo[i]] = gapA
+			cur.scores[alignFrameshift][j-lo[i]] = fs
+			trace[i][j-lo[i]] = t
+		}
+		prev = cur
+	}
+
+	_, state := prev.best(m)
+
+	// Build it up backwards a codon (or whatever) at a time
+	retA := make([]byte, 0, n*3+m)
+	retB := make([]byte, 0, n*3+m)
+	add := func(aPart, bPart string) {
+		for k := len(aPart) - 1; k >= 0; k-- {
+			retA, retB = append(retA, aPart[k]), append(retB, bPart[k])
+		}
+	}
+
+	for i, j := n, m; i > 0 || j > 0; {
+		if (j == lo[i] && lo[i] > 0) || (j == hi[i] && hi[i] < m) {
+			return nil, nil, errAlignBand
+		}
+
+		t := trace[i][j-lo[i]]
+		switch state {
+		case alignBoth:
+			add(string(a[i*3-3:i*3]), string(b[j-3:j]))
+			state = int(t & 3)
+			i, j = i-1, j-3
+		case alignGapB:
+			add(string(a[i*3-3:i*3]), "---")
+			state = int(t>>2) & 3
+			i--
+		case alignGapA:
+			add("---", string(b[j-3:j]))
+			state = int(t>>4) & 3
+			j -= 3
+		case alignFrameshift:
+			state = int(t>>6) & 3
+			switch t >> 8 {
+			case frameshiftB:
+				add("-", string(b[j-1:j]))
+				j--
+			case frameshiftOne:
+				add(string(a[i*3-3:i*3]), string(b[j-1:j])+"--")
+				i, j = i-1, j-1
+			case frameshiftTwo:
+				add(string(a[i*3-3:i*3]), string(b[j-2:j])+"-")
+				i, j = i-1, j-2
+			}
+		}
+	}
+
+	for i, j := 0, len(retA)-1; i < j; i, j = i+1, j-1 {
+		retA[i], retA[j] = retA[j], retA[i]
+		retB[i], retB[j] = retB[j], retB[i]
+	}
+	return retA, retB, nil
+}
+
+// Like Align but for codons, widening the band until it fits
+func AlignCodons(a, b []byte, code *GeneticCode,
+	p CodonAlignParams) ([]byte, []byte) {
+	if len(a) == 0 || len(b) == 0 {
+		retA := append(a[:len(a):len(a)], gapsOfLength(len(b))...)
+		retB := append(gapsOfLength(len(a)), b...)
+		return retA, retB
+	}
+
+	width := p.band
+	for {
+		full := width <= 0 || width >= len(b)
+		if full {
+			width = len(b)
+		}
+
+		retA, retB, err := alignCodonsBanded(a, b, code, &p, width)
+		if err == nil || full {
+			return retA, retB
+		}
+		width *= 2
+	}
+}
+
+func gapsOfLength(n int) []byte {
+	ret := make([]byte, n)
+	for i := range ret {
+		ret[i] = '-'
+	}
+	return ret
+}
+
+/*
+A stretch of the first genome (ungapped coordinates) that's whole codons of
+an ORF, which we can realign codon by codon.
+*/
+type codonRegion struct {
+	start, end int
+	reverse    bool
+	code       *GeneticCode
+}
+
+type codonRegions []codonRegion
+
+func (r codonRegions) Len() int {
+	return len(r)
+}
+
+func (r codonRegions) Less(i, j int) bool {
+	return r[i].start < r[j].start
+}
+
+func (r codonRegions) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+/*
+Find the whole codons of each segment of each ORF. Where ORFs overlap the
+first one wins, and the later one loses whole codons off its start until it
+doesn't overlap any more. So ORFs that are completely inside others (like
+ORF9b) keep whatever alignment the outer one gets.
+*/
+func findCodonRegions(orfs Orfs) codonRegions {
+	ret := make(codonRegions, 0)
+	for _, orf := range orfs {
+		orfPos := 0
+		for _, seg := range orf.segments {
+			length := seg.end - seg.start
+			skip := (3 - orfPos%3) % 3
+			orfPos += length
+			if length < skip {
+				continue
+			}
+			count := (length - skip) / 3 * 3
+
+			r := codonRegion{seg.start + skip, seg.start + skip + count,
+				orf.reverse, orf.code}
+			if orf.reverse {
+				r.start, r.end = seg.end-skip-count, seg.end-skip
+			}
+			if r.start < r.end {
+				ret = append(ret, r)
+			}
+		}
+	}
+	sort.Stable(ret)
+
+	// Codon boundaries are a multiple of 3 from both ends so we can trim
+	// either end by whole codons.
+	trimmed := make(codonRegions, 0, len(ret))
+	for _, r := range ret {
+		if len(trimmed) > 0 {
+			prevEnd := trimmed[len(trimmed)-1].end
+			if r.start < prevEnd {
+				r.start += (prevEnd - r.start + 2) / 3 * 3
+			}
+		}
+		if r.start < r.end {
+			trimmed = append(trimmed, r)
+		}
+	}
+	return trimmed
+}
+
+/*
+Make a codon-aware version of a two genome alignment. Within each ORF we
+realign the second genome against the first codon by codon, using the
+existing alignment to find which part of the second genome goes with it.
+The rest is left as it was. As usual the ORFs of the alignment we return are
+in its columns, and skip over the codons that are gaps in the first genome.
+*/
+func CodonAlign(g *Genomes, p CodonAlignParams) *Genomes {
+	rowA, rowB := g.nts[0], g.nts[1]
+	liftover := g.Liftover(0)
+	orfs := liftover.UnprojectOrfs(g.orfs)
+
+	// The column of the nt at pos, or -1 for the one before the start
+	colOf := func(pos int) int {
+		if pos < 0 {
+			return -1
+		}
+		return liftover.Column(pos)
+	}
+
+	retA := make([]byte, 0, len(rowA))
+	retB := make([]byte, 0, len(rowB))
+
+	col := 0
+	for _, r := range findCodonRegions(orfs) {
+		// What's in the second genome from just after the nt before the
+		// region up to the last nt of the region.
+		first, last := colOf(r.start-1)+1, colOf(r.end-1)
+		retA = append(retA, rowA[col:first]...)
+		retB = append(retB, rowB[col:first]...)
+
+		a := ungapped(rowA[first : last+1])
+		b := ungapped(rowB[first : last+1])
+		if r.reverse {
+			a, b = ReverseComplement(a), ReverseComplement(b)
+		}
+
+		alignedA, alignedB := AlignCodons(a, b, r.code, p)
+		if r.reverse {
+			alignedA = ReverseComplement(alignedA)
+			alignedB = ReverseComplement(alignedB)
+		}
+
+		retA = append(retA, alignedA...)
+		retB = append(retB, alignedB...)
+		col = last + 1
+	}
+	retA = append(retA, rowA[col:]...)
+	retB = append(retB, rowB[col:]...)
+
+	ret := NewGenomes(nil, 2)
+	ret.nts[0], ret.nts[1] = retA, retB
+	copy(ret.names, g.names)
+	ret.orfs = ret.Liftover(0).ProjectOrfs(orfs)
+	return ret
+}
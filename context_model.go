@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+/*
+The 6 kinds of substitution in the usual 96-class trinucleotide scheme
+(the one COSMIC's signatures use). Everything is written from the point of
+view of the pyrimidine, so G>T counts as C>A with its context reverse
+complemented.
+*/
+var contextSubs = [6]string{"C>A", "C>G", "C>T", "T>A", "T>C", "T>G"}
+
+const NUM_CONTEXT_CLASSES = 96
+
+/*
+Turn a nt and its neighbours round onto the other strand if the nt is a
+purine, so that it's always C or T. Returns whether we did.
+*/
+func pyrimidineContext(five, ref, three byte) (byte, byte, byte, bool) {
+	if ref == 'A' || ref == 'G' {
+		return complement(three), complement(ref), complement(five), true
+	}
+	return five, ref, three, false
+}
+
+/*
+The index of a substitution in context (the nt and its neighbours either
+side) to nt to, in the order COSMIC lists them: by substitution, then 5'
+nt, then 3' nt. Returns false if anything isn't one of NTS.
+*/
+func contextClass(context []byte, to byte) (int, bool) {
+	five, ref, three, flip := pyrimidineContext(context[0], context[1],
+		context[2])
+	if flip {
+		to = complement(to)
+	}
+
+	i, j := ntIndex(five), ntIndex(three)
+	if i == -1 || j == -1 {
+		return 0, false
+	}
+	for sub, name := range contextSubs {
+		if name[0] == ref && name[2] == to {
+			return sub*16 + i*4 + j, true
+		}
+	}
+	return 0, false
+}
+
+// The name of a class like COSMIC writes it, e.g. T[C>T]A
+func contextClassName(class int) string {
+	return fmt.Sprintf("%c[%s]%c", NTS[(class/4)%4], contextSubs[class/16],
+		NTS[class%4])
+}
+
+/*
+Proposes replacements by looking at the nts either side of the position,
+with weights for each of the 96 classes. Where we can't tell the context
+(next to a gap, an ambiguity code or the end) we use the weights summed
+over all the contexts. Since the classes don't say which strand a change
+was on, G>A is as likely as C>T in the reverse complement context, which
+isn't really true for a virus like this, but it's what signatures give you.
+The weights decide which positions get picked as well as what they turn
+into (see WeightPositions).
+*/
+type ContextModel struct {
+	name    string
+	weights [NUM_CONTEXT_CLASSES]float64
+
+	// For C and T, what they become in each context (5' nt * 4 + 3' nt)
+	tables   [2][16]*aliasTable
+	marginal [2]*aliasTable
+	uniform  *aliasTable // For ambiguity codes
+}
+
+func NewContextModel(name string,
+	weights [NUM_CONTEXT_CLASSES]float64) *ContextModel {
+	ret := ContextModel{name: name, weights: weights,
+		uniform: newAliasTable([]byte(NTS), make([]float64, len(NTS)))}
+
+	for ref := 0; ref < 2; ref++ {
+		marginal := make([]float64, 3)
+		values := make([]byte, 3)
+		for s := 0; s < 3; s++ {
+			values[s] = contextSubs[ref*3+s][2]
+		}
+
+		for ctx := 0; ctx < 16; ctx++ {
+			w := make([]float64, 3)
+			for s := 0; s < 3; s++ {
+				w[s] = weights[(ref*3+s)*16+ctx]
+				marginal[s] += w[s]
+			}
+			ret.tables[ref][ctx] = newAliasTable(values, w)
+		}
+		ret.marginal[ref] = newAliasTable(values, marginal)
+	}
+	return &ret
+}
+
+/*
+Fold a Spectrum into the 96 classes, ignoring which ORF and codon position
+each change was in.
+*/
+func ContextModelFromSpectrum(s *Spectrum) *ContextModel {
+	var weights [NUM_CONTEXT_CLASSES]float64
+	context := make([]byte, 3)
+	for k, c := range s.counts {
+		copy(context, k.context)
+		for to := 0; to < 4; to++ {
+			if c.to[to] == 0 {
+				continue
+			}
+			if class, ok := contextClass(context, NTS[to]); ok {
+				weights[class] += float64(c.to[to])
+			}
+		}
+	}
+	return NewContextModel("Fitted", weights)
+}
+
+/*
+Load a signature in COSMIC's format: a tab-separated file where the first
+column is the class (like A[C>A]A) and the second is its weight. Any other
+columns (other signatures) are ignored, and so is a header line.
+*/
+func LoadContextModel(fname string) (*ContextModel, error) {
+	fd, err := openInput(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	classes := make(map[string]int)
+	for i := 0; i < NUM_CONTEXT_CLASSES; i++ {
+		classes[contextClassName(i)] = i
+	}
+
+	var weights [NUM_CONTEXT_CLASSES]float64
+	var seen [NUM_CONTEXT_CLASSES]bool
+	numSeen := 0
+	err = forEachLine(bufio.NewReader(fd), fname,
+		func(line string, lineNum int) error {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				return nil
+			}
+
+			class, there := classes[fields[0]]
+			if !there {
+				if lineNum == 1 {
+					// Header
+					return nil
+				}
+				return loadError(fname, lineNum, "Unknown class \"%s\"",
+					fields[0])
+			}
+
+			if len(fields) < 2 {
+				return loadError(fname, lineNum, "No weight for %s",
+					fields[0])
+			}
+			w, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil || w < 0 {
+				return loadError(fname, lineNum,
+					"Weight \"%s\" isn't a non-negative number", fields[1])
+			}
+			if seen[class] {
+				return loadError(fname, lineNum, "%s is there twice",
+					fields[0])
+			}
+
+			weights[class], seen[class] = w, true
+			numSeen++
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if numSeen != NUM_CONTEXT_CLASSES {
+		return nil, loadError(fname, 0, "Expected %d classes but got %d",
+			NUM_CONTEXT_CLASSES, numSeen)
+	}
+	return NewContextModel(fname, weights), nil
+}
+
+/*
+Where pos in nts is in the tables: 0 for C and 1 for T once it's been turned
+round onto the pyrimidine strand, its context (5' nt * 4 + 3' nt) or -1 if we
+can't tell it, and whether it was turned round. r is -1 if pos is an
+ambiguity code.
+*/
+func contextAt(nts []byte, pos int) (r, ctx int, flip bool) {
+	if ntIndex(nts[pos]) == -1 {
+		return -1, -1, false
+	}
+
+	// The ends count as not knowing the context
+	five, three := byte('N'), byte('N')
+	if pos > 0 && pos+1 < len(nts) {
+		five, three = nts[pos-1], nts[pos+1]
+	}
+	five, ref, three, flip := pyrimidineContext(five, nts[pos], three)
+
+	if ref == 'T' {
+		r = 1
+	}
+	i, j := ntIndex(five), ntIndex(three)
+	if i == -1 || j == -1 {
+		return r, -1, flip
+	}
+	return r, i*4 + j, flip
+}
+
+func (m *ContextModel) Draw(genome *Genomes, pos int, rng *rand.Rand) byte {
+	r, ctx, flip := contextAt(genome.nts[0], pos)
+	if r == -1 {
+		return m.uniform.draw(rng)
+	}
+
+	var ret byte
+	if ctx == -1 {
+		ret = m.marginal[r].draw(rng)
+	} else {
+		ret = m.tables[r][ctx].draw(rng)
+	}
+
+	if flip {
+		ret = complement(ret)
+	}
+	return ret
+}
+
+/*
+The weights are how the mutations are shared out between the classes, not
+how fast each site mutates, so to get that we divide each context's total
+(over the 3 things it can become) between the positions that have it,
+counting each position as much as weights already says it's likely to be
+picked. So if T[C>T]A has 10 times the weight of A[C>T]A there end up being
+about 10 times as many of them, however many of each context the genome
+has. Positions where we can't tell the context get the average rate for a C
+or T.
+*/
+func (m *ContextModel) WeightPositions(genome *Genomes, weights []float64) {
+	nts := genome.nts[0]
+	var totals, counts [2][16]float64
+	for pos := range nts {
+		r, ctx, _ := contextAt(nts, pos)
+		if r != -1 && ctx != -1 {
+			counts[r][ctx] += weights[pos]
+		}
+	}
+
+	var rates [2][16]float64
+	var averages [2]float64
+	for r := 0; r < 2; r++ {
+		total, count := 0.0, 0.0
+		for ctx := 0; ctx < 16; ctx++ {
+			for s := 0; s < 3; s++ {
+				totals[r][ctx] += m.weights[(r*3+s)*16+ctx]
+			}
+			if counts[r][ctx] > 0 {
+				rates[r][ctx] = totals[r][ctx] / counts[r][ctx]
+				total += totals[r][ctx]
+				count += counts[r][ctx]
+			}
+		}
+		if count > 0 {
+			averages[r] = total / count
+		}
+	}
+
+	for pos := range nts {
+		r, ctx, _ := contextAt(nts, pos)
+		switch {
+		case r == -1:
+			// SiteRates never picks these anyway
+		case ctx == -1:
+			weights[pos] *= averages[r]
+		default:
+			weights[pos] *= rates[r][ctx]
+		}
+	}
+}
+
+// Show the weights as percentages, a line for each substitution and 5' nt
+func (m *ContextModel) Show() {
+	total := 0.0
+	for _, w := range m.weights {
+		total += w
+	}
+	if total == 0 {
+		total = 1
+	}
+
+	fmt.Printf("%s trinucleotide context model:\n", m.name)
+	for class := 0; class < NUM_CONTEXT_CLASSES; class += 4 {
+		line := make([]string, 4)
+		for j := 0; j < 4; j++ {
+			line[j] = fmt.Sprintf("%s %5.2f%%", contextClassName(class+j),
+				100*m.weights[class+j]/total)
+		}
+		fmt.Println(strings.Join(line, "  "))
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+/*
+Optional key=value pairs that go on the header line of a FASTA record after
+the name, e.g. ">BtSY2-mutant-12 num_muts=763 source=BtSY2 trial=12". They
+are written sorted by key so that the output doesn't depend on map order.
+*/
+type FastaMetadata map[string]string
+
+func (m FastaMetadata) String() string {
+	keys := make([]string, 0, len(m))
+	for k, _ := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := make([]string, len(keys))
+	for i, k := range keys {
+		// Spaces would make the header ambiguous
+		fields[i] = k + "=" + strings.Replace(m[k], " ", "_", -1)
+	}
+	return strings.Join(fields, " ")
+}
+
+/*
+Writes any number of records to a multi-record FASTA file, wrapping the
+sequences at width nts per line (0 means don't wrap).
+*/
+type FastaWriter struct {
+	fp    *bufio.Writer
+	width int
+}
+
+func NewFastaWriter(w io.Writer, width int) *FastaWriter {
+	return &FastaWriter{bufio.NewWriter(w), width}
+}
+
+// Write one record. metadata can be nil.
+func (w *FastaWriter) Write(name string, metadata FastaMetadata,
+	nts []byte) error {
+	header := ">" + name
+	if len(metadata) > 0 {
+		header += " " + metadata.String()
+	}
+	if _, err := fmt.Fprintln(w.fp, header); err != nil {
+		return err
+	}
+
+	ll := w.width
+	if ll <= 0 {
+		ll = len(nts)
+	}
+	for i := 0; i < len(nts); i += ll {
+		end := i + ll
+		if end > len(nts) {
+			end = len(nts)
+		}
+		if _, err := fmt.Fprintf(w.fp, "%s\n", nts[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// You must call this when you're done or the end may not get written
+func (w *FastaWriter) Flush() error {
+	return w.fp.Flush()
+}
+
+/*
+Make a FastaWriter that writes to a new file fname ("-" for stdout, and
+gzipped if it ends with .gz), and returns a function
+to call when you're done which flushes and closes it.
+*/
+func CreateFasta(fname string, width int) (*FastaWriter, func() error,
+	error) {
+	fd, err := createOutput(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w := NewFastaWriter(fd, width)
+	done := func() error {
+		err := w.Flush()
+		if closeErr := fd.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	return w, done, nil
+}
+
+/*
+Reads a FASTA file one record at a time, so that big collections of genomes
+don't have to be in memory all at once. Nucleotides are uppercased and
+checked as they're read. LoadGenome only reads the first record, but
+LoadGenomes keeps every one, since it needs all the rows of an alignment.
+*/
+type FastaReader struct {
+	fname   string // For errors
+	fp      *bufio.Reader
+	lineNum int
+	header  string // The header of the record we're about to read
+	line    int    // Where the last record Next returned started
+}
+
+func NewFastaReader(r io.Reader, fname string) *FastaReader {
+	return &FastaReader{fname: fname, fp: bufio.NewReader(r)}
+}
+
+/*
+Return the name and nts of the next record, or io.EOF if there aren't any
+more. The name is the first word of the header.
+*/
+func (r *FastaReader) Next() (string, []byte, error) {
+	nts := make([]byte, 0)
+	headerLine := r.lineNum
+
+	for {
+		line, err := r.fp.ReadString('\n')
+		switch err {
+		case io.EOF:
+			if line == "" {
+				if r.header == "" {
+					return "", nil, io.EOF
+				}
+				header := r.header
+				r.header = ""
+				return r.record(header, headerLine, nts)
+			}
+		case nil:
+			break
+		default:
+			return "", nil, &LoadError{r.fname, r.lineNum, err}
+		}
+		r.lineNum++
+
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, ">") {
+			if r.header != "" {
+				header := r.header
+				r.header = line
+				return r.record(header, headerLine, nts)
+			}
+			r.header = line
+			headerLine = r.lineNum
+			continue
+		}
+
+		if line == "" {
+			continue
+		}
+
+		if r.header == "" {
+			return "", nil, loadError(r.fname, r.lineNum,
+				"Sequence before header")
+		}
+
+		upper := []byte(strings.ToUpper(line))
+		for i, nt := range upper {
+			if !isValidNt(nt) {
+				return "", nil, loadError(r.fname, r.lineNum,
+					"Bad nucleotide '%c' in column %d", line[i], i+1)
+			}
+		}
+		nts = append(nts, upper...)
+	}
+}
+
+func (r *FastaReader) record(header string, line int,
+	nts []byte) (string, []byte, error) {
+	r.line = line
+	fields := strings.Fields(header[1:])
+	if len(fields) == 0 {
+		return "", nil, loadError(r.fname, line, "Header with no name")
+	}
+	return fields[0], nts, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+)
+
+// Stdin and stdout shouldn't get closed when we're done with them
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Closes the decompressor and then the file under it
+type gzipReadCloser struct {
+	*gzip.Reader
+	fd io.Closer
+}
+
+func (r *gzipReadCloser) Close() error {
+	err := r.Reader.Close()
+	if fdErr := r.fd.Close(); err == nil {
+		err = fdErr
+	}
+	return err
+}
+
+type gzipWriteCloser struct {
+	*gzip.Writer
+	fd io.Closer
+}
+
+func (w *gzipWriteCloser) Close() error {
+	err := w.Writer.Close()
+	if fdErr := w.fd.Close(); err == nil {
+		err = fdErr
+	}
+	return err
+}
+
+/*
+The first of base followed by each of exts that's there, trying each one
+with .gz and .bgz on the end as well. Returns "" if none of them are.
+*/
+func findInput(base string, exts ...string) string {
+	for _, ext := range exts {
+		for _, fname := range []string{base + ext, base + ext + ".gz",
+			base + ext + ".bgz"} {
+			if _, err := os.Stat(fname); err == nil {
+				return fname
+			}
+		}
+	}
+	return ""
+}
+
+/*
+Open a file for reading, where "-" means stdin. If it's gzipped we
+decompress it on the fly, which we detect by looking at the first couple of
+bytes rather than the name. bgzip files are just a series of gzip members
+so they work too.
+*/
+func openInput(fname string) (io.ReadCloser, error) {
+	var fd io.ReadCloser
+	if fname == "-" {
+		fd = io.NopCloser(os.Stdin)
+	} else {
+		var err error
+		fd, err = os.Open(fname)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fp := bufio.NewReader(fd)
+	magic, _ := fp.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(fp)
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		return &gzipReadCloser{zr, fd}, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{fp, fd}, nil
+}
+
+/*
+Create a file for writing, where "-" means stdout. If the name ends with
+.gz or .bgz it will be gzipped (as one gzip member, so not something you
+could index with tabix).
+*/
+func createOutput(fname string) (io.WriteCloser, error) {
+	if fname == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+
+	fd, err := os.Create(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(fname, ".gz") || strings.HasSuffix(fname, ".bgz") {
+		return &gzipWriteCloser{gzip.NewWriter(fd), fd}, nil
+	}
+	return fd, nil
+}
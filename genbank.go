@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+A feature from the FEATURES table of a GenBank flat file, e.g. a CDS with
+its location string and its qualifiers (/gene, /product etc.)
+*/
+type gbFeature struct {
+	key        string
+	location   string
+	qualifiers map[string]string
+	line       int // Where it started in the file
+}
+
+// Locations that refer to other records, which we can't do anything with
+var errRemoteLocation = errors.New("Remote location")
+
+// One contiguous piece of a feature location. 0-based, end exclusive.
+type gbSpan struct {
+	start, end int
+	complement bool
+}
+
+/*
+A very small recursive descent parser for GenBank feature locations, which
+look like "266..13468", "join(266..13468,13468..21555)" or
+"complement(join(<1..100,200..>300))".
+*/
+type gbLocationParser struct {
+	s   string
+	pos int
+}
+
+func (p *gbLocationParser) peek(prefix string) bool {
+	return strings.HasPrefix(p.s[p.pos:], prefix)
+}
+
+func (p *gbLocationParser) expect(s string) error {
+	if !p.peek(s) {
+		return errors.New("Expected " + s + " in location " + p.s)
+	}
+	p.pos += len(s)
+	return nil
+}
+
+func (p *gbLocationParser) number() (int, error) {
+	// Partial markers just tell us the feature extends beyond what was
+	// sequenced. We don't care.
+	if p.peek("<") || p.peek(">") {
+		p.pos++
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+		p.pos++
+	}
+	return strconv.Atoi(p.s[start:p.pos])
+}
+
+func (p *gbLocationParser) parse(complement bool) ([]gbSpan, error) {
+	switch {
+	case p.peek("complement("):
+		p.pos += len("complement(")
+		spans, err := p.parse(!complement)
+		if err != nil {
+			return nil, err
+		}
+
+		// The parts of a complemented join are read in the opposite order
+		for i, j := 0, len(spans)-1; i < j; i, j = i+1, j-1 {
+			spans[i], spans[j] = spans[j], spans[i]
+		}
+		return spans, p.expect(")")
+
+	case p.peek("join("), p.peek("order("):
+		p.pos = strings.Index(p.s[p.pos:], "(") + p.pos + 1
+		ret := make([]gbSpan, 0)
+		for {
+			spans, err := p.parse(complement)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, spans...)
+			if !p.peek(",") {
+				break
+			}
+			p.pos++
+		}
+		return ret, p.expect(")")
+	}
+
+	if strings.ContainsRune(p.s, ':') {
+		return nil, errRemoteLocation
+	}
+
+	start, err := p.number()
+	if err != nil {
+		return nil, err
+	}
+	end := start
+
+	switch {
+	case p.peek(".."):
+		p.pos += 2
+		end, err = p.number()
+		if err != nil {
+			return nil, err
+		}
+	case p.peek("^"):
+		// A site between two bases, which can't be a CDS
+		return nil, errors.New("Between-base location " + p.s)
+	}
+
+	// GenBank locations are 1-based and inclusive
+	return []gbSpan{{start - 1, end, complement}}, nil
+}
+
+func parseGbLocation(location string) ([]gbSpan, error) {
+	p := gbLocationParser{s: location}
+	spans, err := p.parse(false)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(location) {
+		return nil, errors.New("Trailing junk in location " + location)
+	}
+	return spans, nil
+}
+
+/*
+Turn the CDS features into Orfs. Each part of a join becomes a segment of
+the Orf, so that ORF1ab's frameshift is handled properly. We don't handle
+CDSs with parts on both strands (trans-splicing) or in other records so
+those are skipped.
+*/
+func gbOrfs(fname string, features []gbFeature) (Orfs, error) {
+	ret := make(Orfs, 0)
+
+	for _, f := range features {
+		if f.key != "CDS" {
+			continue
+		}
+
+		spans, err := parseGbLocation(f.location)
+		if err == errRemoteLocation {
+			continue
+		}
+		if err != nil {
+			return nil, &LoadError{fname, f.line, err}
+		}
+
+		reverse := spans[0].complement
+		mixed := false
+		for _, span := range spans {
+			if span.complement != reverse {
+				mixed = true
+			}
+		}
+		if mixed {
+			continue
+		}
+
+		codonStart := 1
+		if cs, there := f.qualifiers["codon_start"]; there {
+			codonStart, err = strconv.Atoi(cs)
+			if err != nil || codonStart < 1 || codonStart > 3 {
+				return nil, loadError(fname, f.line,
+					"Bad codon_start \"%s\"", cs)
+			}
+		}
+		// On the minus strand the first part is read from its end
+		if reverse {
+			spans[0].end -= codonStart - 1
+		} else {
+			spans[0].start += codonStart - 1
+		}
+
+		segments := make([]Segment, len(spans))
+		for i, span := range spans {
+			segments[i] = Segment{span.start, span.end}
+		}
+
+		orf := NewOrf(segments, reverse)
+		orf.line = f.line
+		if tt, there := f.qualifiers["transl_table"]; there {
+			id, err := strconv.Atoi(tt)
+			if err != nil {
+				return nil, loadError(fname, f.line,
+					"Bad transl_table \"%s\"", tt)
+			}
+			orf.code, err = GetGeneticCode(id)
+			if err != nil {
+				return nil, &LoadError{fname, f.line, err}
+			}
+		}
+		orf.gene, orf.product = f.qualifiers["gene"], f.qualifiers["product"]
+		ret = append(ret, orf)
+	}
+
+	sort.Sort(ret)
+	return ret, nil
+}
+
+/*
+Pick a name for the genome. We prefer the isolate or strain since that's
+what people tend to put in the headers of the fasta files (e.g. Wuhan-Hu-1
+rather than MN908947.3).
+*/
+func gbName(features []gbFeature, version, locus string) string {
+	for _, f := range features {
+		if f.key != "source" {
+			continue
+		}
+		for _, q := range []string{"isolate", "strain"} {
+			if name, there := f.qualifiers[q]; there {
+				return strings.Replace(name, " ", "_", -1)
+			}
+		}
+	}
+
+	if version != "" {
+		return version
+	}
+	return locus
+}
+
+/*
+Load a GenBank flat file, which gives us both the sequence and the ORFs
+(from the CDS features). If there is more than one record in the file each
+one becomes a row, and the ORFs come from the first one.
+*/
+func LoadGenBank(fname string) (*Genomes, error) {
+	ret := NewGenomes(nil, 0)
+
+	fd, err := openInput(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	fp := bufio.NewReader(fd)
+
+	const (
+		HEADER = iota
+		FEATURES
+		ORIGIN
+	)
+	section := HEADER
+
+	var locus, version string
+	var features []gbFeature
+	var feature *gbFeature
+	var qualifier string
+	nts := make([]byte, 0)
+	lineNum := 0
+
+	endRecord := func() error {
+		if ret.orfs == nil {
+			var err error
+			ret.orfs, err = gbOrfs(fname, features)
+			if err != nil {
+				return err
+			}
+		}
+
+		name := gbName(features, version, locus)
+		if ret.NumGenomes() > 0 && len(nts) != ret.Length() {
+			return loadError(fname, lineNum,
+				"%s is length %d but %s is length %d", name, len(nts),
+				ret.names[0], ret.Length())
+		}
+
+		ret.names = append(ret.names, name)
+		ret.nts = append(ret.nts, nts)
+
+		section = HEADER
+		locus, version = "", ""
+		features, feature, qualifier = nil, nil, ""
+		nts = make([]byte, 0)
+		return nil
+	}
+
+loop:
+	for {
+		line, err := fp.ReadString('\n')
+		switch err {
+		case io.EOF:
+			if line == "" {
+				break loop
+			}
+		case nil:
+			break
+		default:
+			return nil, &LoadError{fname, lineNum, err}
+		}
+		lineNum++
+
+		line = strings.TrimRight(line, "\r\n")
+		fields := strings.Fields(line)
+
+		if strings.HasPrefix(line, "//") {
+			if err := endRecord(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		switch section {
+		case HEADER:
+			switch {
+			case strings.HasPrefix(line, "LOCUS") && len(fields) > 1:
+				locus = fields[1]
+			case strings.HasPrefix(line, "VERSION") && len(fields) > 1:
+				version = fields[1]
+			case strings.HasPrefix(line, "FEATURES"):
+				section = FEATURES
+			case strings.HasPrefix(line, "ORIGIN"):
+				section = ORIGIN
+			}
+
+		case FEATURES:
+			if !strings.HasPrefix(line, " ") {
+				// Something like BASE COUNT, CONTIG or ORIGIN ends the
+				// features.
+				if strings.HasPrefix(line, "ORIGIN") {
+					section = ORIGIN
+				} else {
+					section = HEADER
+				}
+				continue
+			}
+
+			if len(line) > 5 && line[5] != ' ' {
+				features = append(features, gbFeature{fields[0],
+					strings.Join(fields[1:], ""), make(map[string]string),
+					lineNum})
+				feature = &features[len(features)-1]
+				qualifier = ""
+				continue
+			}
+
+			if feature == nil {
+				continue
+			}
+
+			text := strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(text, "/"):
+				kv := strings.SplitN(text[1:], "=", 2)
+				qualifier = kv[0]
+				value := ""
+				if len(kv) > 1 {
+					value = kv[1]
+				}
+				feature.qualifiers[qualifier] = value
+			case qualifier == "":
+				// Locations can wrap onto more than one line
+				feature.location += text
+			case qualifier == "translation":
+				feature.qualifiers[qualifier] += text
+			default:
+				feature.qualifiers[qualifier] += " " + text
+			}
+
+			if qualifier != "" {
+				feature.qualifiers[qualifier] =
+					strings.Trim(feature.qualifiers[qualifier], "\"")
+			}
+
+		case ORIGIN:
+			for _, f := range fields {
+				if f[0] >= '0' && f[0] <= '9' {
+					continue
+				}
+				f = strings.ToUpper(f)
+				for i := 0; i < len(f); i++ {
+					if !isValidNt(f[i]) {
+						return nil, loadError(fname, lineNum,
+							"Bad nucleotide '%c'", f[i])
+					}
+				}
+				nts = append(nts, []byte(f)...)
+			}
+		}
+	}
+
+	// Be forgiving about a missing // at the end of the file
+	if len(nts) > 0 {
+		if err := endRecord(); err != nil {
+			return nil, err
+		}
+	}
+
+	if ret.NumGenomes() == 0 {
+		return nil, loadError(fname, 0, "No sequences")
+	}
+
+	if err := ret.checkOrfs(fname); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+A genetic code (translation table) as numbered by NCBI. See
+https://www.ncbi.nlm.nih.gov/Taxonomy/Utils/wprintgc.cgi
+*/
+type GeneticCode struct {
+	id     int
+	name   string
+	table  [64]byte          // The aa for each codon, by codonIndex
+	codons map[byte][]string // All the codons for each aa
+	starts map[string]bool   // The codons that can be used as starts
+}
+
+/*
+Each code as in NCBI's gc.prt: the aas for each of the 64 codons with the
+bases in the order TCAG (so TTT, TTC, TTA, TTG, TCT...), and the codons it
+allows as starts.
+*/
+var geneticCodeDefs = []struct {
+	id     int
+	name   string
+	aas    string
+	starts []string
+}{
+	{1, "Standard",
+		"FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"TTG", "CTG", "ATG"}},
+	{2, "Vertebrate Mitochondrial",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNKKSS**VVVVAAAADDEEGGGG",
+		[]string{"ATT", "ATC", "ATA", "ATG", "GTG"}},
+	{3, "Yeast Mitochondrial",
+		"FFLLSSSSYY**CCWWTTTTPPPPHHQQRRRRIIMMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"ATA", "ATG", "GTG"}},
+	{4, "Mold, Protozoan, and Coelenterate Mitochondrial and " +
+		"Mycoplasma/Spiroplasma",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"TTA", "TTG", "CTG", "ATT", "ATC", "ATA", "ATG", "GTG"}},
+	{5, "Invertebrate Mitochondrial",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNKKSSSSVVVVAAAADDEEGGGG",
+		[]string{"TTG", "ATT", "ATC", "ATA", "ATG", "GTG"}},
+	{6, "Ciliate, Dasycladacean and Hexamita Nuclear",
+		"FFLLSSSSYYQQCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"ATG"}},
+	{9, "Echinoderm and Flatworm Mitochondrial",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNNKSSSSVVVVAAAADDEEGGGG",
+		[]string{"ATG", "GTG"}},
+	{10, "Euplotid Nuclear",
+		"FFLLSSSSYY**CCCWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"ATG"}},
+	{11, "Bacterial, Archaeal and Plant Plastid",
+		"FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"TTG", "CTG", "ATT", "ATC", "ATA", "ATG", "GTG"}},
+	{12, "Alternative Yeast Nuclear",
+		"FFLLSSSSYY**CC*WLLLSPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"CTG", "ATG"}},
+	{13, "Ascidian Mitochondrial",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNKKSSGGVVVVAAAADDEEGGGG",
+		[]string{"TTG", "ATA", "ATG", "GTG"}},
+	{14, "Alternative Flatworm Mitochondrial",
+		"FFLLSSSSYYY*CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNNKSSSSVVVVAAAADDEEGGGG",
+		[]string{"ATG"}},
+	{15, "Blepharisma Nuclear",
+		"FFLLSSSSYY*QCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"ATG"}},
+	{16, "Chlorophycean Mitochondrial",
+		"FFLLSSSSYY*LCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"ATG"}},
+	{21, "Trematode Mitochondrial",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNNKSSSSVVVVAAAADDEEGGGG",
+		[]string{"ATG", "GTG"}},
+	{22, "Scenedesmus obliquus Mitochondrial",
+		"FFLLSS*SYY*LCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"ATG"}},
+	{23, "Thraustochytrium Mitochondrial",
+		"FF*LSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"ATT", "ATG", "GTG"}},
+	{24, "Rhabdopleuridae Mitochondrial",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSSKVVVVAAAADDEEGGGG",
+		[]string{"TTG", "CTG", "ATG", "GTG"}},
+	{25, "Candidate Division SR1 and Gracilibacteria",
+		"FFLLSSSSYY**CCGWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"TTG", "ATG", "GTG"}},
+	{26, "Pachysolen tannophilus Nuclear",
+		"FFLLSSSSYY**CC*WLLLAPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"CTG", "ATG"}},
+	{27, "Karyorelict Nuclear",
+		"FFLLSSSSYYQQCCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"ATG"}},
+	{28, "Condylostoma Nuclear",
+		"FFLLSSSSYYQQCCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"ATG"}},
+	{29, "Mesodinium Nuclear",
+		"FFLLSSSSYYYYCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"ATG"}},
+	{30, "Peritrich Nuclear",
+		"FFLLSSSSYYEECC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"ATG"}},
+	{31, "Blastocrithidia Nuclear",
+		"FFLLSSSSYYEECCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"ATG"}},
+	{32, "Balanophoraceae Plastid",
+		"FFLLSSSSYY*WCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG",
+		[]string{"TTG", "CTG", "ATT", "ATC", "ATA", "ATG", "GTG"}},
+	{33, "Cephalodiscidae Mitochondrial",
+		"FFLLSSSSYYY*CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSSKVVVVAAAADDEEGGGG",
+		[]string{"TTG", "CTG", "ATG", "GTG"}},
+}
+
+// The order the bases go in in the NCBI tables
+const codeBases = "TCAG"
+
+var GeneticCodes map[int]*GeneticCode
+
+// The one everything uses unless it says otherwise
+var StandardCode *GeneticCode
+
+/*
+If this is set every ORF we load is translated with it, whatever its
+annotations say (see -code).
+*/
+var OverrideCode *GeneticCode
+
+// The index of each base in codeBases, or -1 if it isn't one of them
+var baseIndex [256]int
+
+// What each IUPAC ambiguity code could be
+var iupacBases = map[byte]string{
+	'A': "A", 'C': "C", 'G': "G", 'T': "T", 'U': "T",
+	'R': "AG", 'Y': "CT", 'S': "CG", 'W': "AT", 'K': "GT", 'M': "AC",
+	'B': "CGT", 'D': "AGT", 'H': "ACT", 'V': "ACG", 'N': "ACGT",
+}
+
+// Whether nt is a real nucleotide rather than an ambiguity code or a gap
+func isUnambiguous(nt byte) bool {
+	return baseIndex[nt] >= 0
+}
+
+/*
+The index of a codon into the table, or -1 if it contains anything other
+than TCAG
+*/
+func codonIndex(codon []byte) int {
+	ret := 0
+	for i := 0; i < 3; i++ {
+		b := baseIndex[codon[i]]
+		if b < 0 {
+			return -1
+		}
+		ret = ret*4 + b
+	}
+	return ret
+}
+
+func GetGeneticCode(id int) (*GeneticCode, error) {
+	code, there := GeneticCodes[id]
+	if !there {
+		return nil, fmt.Errorf("Unknown genetic code %d", id)
+	}
+	return code, nil
+}
+
+/*
+Return the aa for a codon. If it contains ambiguity codes we try all the
+codons it could be, and if they all code for the same aa that's the answer
+(so GGN is G). Otherwise, or if it contains a gap or anything else we don't
+understand, it's X.
+*/
+func (gc *GeneticCode) Translate(codon []byte) byte {
+	i := codonIndex(codon)
+	if i >= 0 {
+		return gc.table[i]
+	}
+
+	var ret byte
+	var expanded [3]byte
+	for _, a := range iupacBases[codon[0]] {
+		expanded[0] = byte(a)
+		for _, b := range iupacBases[codon[1]] {
+			expanded[1] = byte(b)
+			for _, c := range iupacBases[codon[2]] {
+				expanded[2] = byte(c)
+				aa := gc.table[codonIndex(expanded[:])]
+				if ret != 0 && aa != ret {
+					return 'X'
+				}
+				ret = aa
+			}
+		}
+	}
+
+	// We get here with ret still 0 if any of them weren't IUPAC codes
+	if ret == 0 {
+		return 'X'
+	}
+	return ret
+}
+
+// All the codons for aa, always in the same order
+func (gc *GeneticCode) Codons(aa byte) []string {
+	return gc.codons[aa]
+}
+
+func (gc *GeneticCode) IsStart(codon []byte) bool {
+	return gc.starts[string(codon)]
+}
+
+/*
+Assume nts are codon aligned and return a translation, with one amino-acid
+letter per nt, so something like LLLRRRIII. The nts have to be in the order
+they're read, so use ReverseComplement first for the minus strand.
+*/
+func (gc *GeneticCode) TranslateAligned(nts []byte) []byte {
+	ret := make([]byte, len(nts))
+
+	for i := 0; i+3 <= len(nts); i += 3 {
+		aa := gc.Translate(nts[i : i+3])
+		for j := 0; j < 3; j++ {
+			ret[i+j] = aa
+		}
+	}
+	return ret
+}
+
+func (gc *GeneticCode) String() string {
+	return fmt.Sprintf("%d (%s)", gc.id, gc.name)
+}
+
+// Print the table numbers and names
+func ShowGeneticCodes() {
+	ids := make([]int, 0, len(GeneticCodes))
+	for id := range GeneticCodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		fmt.Println(GeneticCodes[id])
+	}
+}
+
+func init() {
+	for i := range baseIndex {
+		baseIndex[i] = -1
+	}
+	for i := 0; i < len(codeBases); i++ {
+		baseIndex[codeBases[i]] = i
+	}
+
+	GeneticCodes = make(map[int]*GeneticCode)
+	for _, def := range geneticCodeDefs {
+		gc := GeneticCode{id: def.id, name: def.name,
+			codons: make(map[byte][]string),
+			starts: make(map[string]bool)}
+
+		for i := 0; i < 64; i++ {
+			codon := []byte{codeBases[i/16], codeBases[(i/4)%4],
+				codeBases[i%4]}
+			aa := def.aas[i]
+			gc.table[i] = aa
+			gc.codons[aa] = append(gc.codons[aa], string(codon))
+		}
+
+		for _, start := range def.starts {
+			gc.starts[start] = true
+		}
+		GeneticCodes[def.id] = &gc
+	}
+
+	StandardCode = GeneticCodes[1]
+}
@@ -4,95 +4,231 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
-	"os"
+	"path/filepath"
 	"strings"
 )
 
 /*
 Represents a collection of aligned genomes (usually two) with one genome
-per row. The orfs "belong" to the first one in the set. We also use this
-for a single genome.
+per row. The orfs "belong" to the first one in the set, but they're always
+in the alignment's columns, so if the first genome has gaps they won't be
+the same as in its .orfs file (see Liftover). We also use this for a single
+genome.
 */
 type Genomes struct {
-	nts   [][]byte
-	names []string
-	orfs  Orfs
+	nts    [][]byte
+	names  []string
+	orfs   Orfs
+	shifts []shift // Indels made in the first genome (see MovePosition)
 }
 
 func NewGenomes(orfs Orfs, numGenomes int) *Genomes {
 	return &Genomes{make([][]byte, numGenomes),
-		make([]string, numGenomes), orfs}
+		make([]string, numGenomes), orfs, nil}
+}
+
+/*
+An error from loading a file, with where in the file it went wrong if we
+know. line is 0 if it's not about any particular line.
+*/
+type LoadError struct {
+	fname string
+	line  int
+	err   error
+}
+
+func (e *LoadError) Error() string {
+	if e.line == 0 {
+		return fmt.Sprintf("%s: %s", e.fname, e.err)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.fname, e.line, e.err)
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.err
+}
+
+func loadError(fname string, line int, format string,
+	args ...interface{}) error {
+	return &LoadError{fname, line, fmt.Errorf(format, args...)}
+}
+
+// Whether nt is something we expect to find in a fasta file
+func isValidNt(nt byte) bool {
+	if nt == '-' {
+		return true
+	}
+	_, there := iupacBases[nt]
+	return there
 }
 
 /*
 Load genomes, which might be a fasta file containing a single genome, or
 one containing a few of them in an alignment. Be a bit careful when working
-with alignments since there may be '-' in there
+with alignments since there may be '-' in there. The ORFs can be in our own
+.orfs format or in GFF3. Either file can be gzipped, and fname can be "-" to
+read from stdin. As well as FASTA, the genomes can be a Clustal, Stockholm
+or PHYLIP alignment, which we tell apart by looking at the start of the
+file.
 */
-func LoadGenomes(fname string, orfsName string) *Genomes {
-	ret := NewGenomes(LoadOrfs(orfsName), 0)
+func LoadGenomes(fname string, orfsName string) (*Genomes, error) {
+	orfs, err := loadAnyOrfs(orfsName)
+	if err != nil {
+		return nil, err
+	}
+	ret := NewGenomes(orfs, 0)
 
-	fd, err := os.Open(fname)
+	fd, err := openInput(fname)
 	if err != nil {
-		log.Fatal("Can't open file")
+		return nil, err
 	}
 	defer fd.Close()
 
-	fp := bufio.NewReader(fd)
+	rows, err := readAlignment(bufio.NewReader(fd), fname)
+	if err != nil {
+		return nil, err
+	}
+	ret.names, ret.nts = rows.names, rows.nts
+
+	if len(ret.names) == 0 {
+		return nil, loadError(fname, 0, "No sequences")
+	}
+
+	for i := 1; i < ret.NumGenomes(); i++ {
+		if len(ret.nts[i]) != len(ret.nts[0]) {
+			return nil, loadError(fname, rows.lines[i],
+				"%s is length %d but %s is length %d", ret.names[i],
+				len(ret.nts[i]), ret.names[0], len(ret.nts[0]))
+		}
+	}
+
+	if err := ret.checkOrfs(orfsName); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+/*
+Load a single genome, which is the first record in fname, with its ORFs
+from orfsName (see LoadGenomes). If it's FASTA we stop reading as soon as
+we've got that record, so fname can be a big collection of genomes without
+them all having to fit in memory. The other formats are alignments, which
+we have to read whole, and we just keep the first row.
+*/
+func LoadGenome(fname string, orfsName string) (*Genomes, error) {
+	orfs, err := loadAnyOrfs(orfsName)
+	if err != nil {
+		return nil, err
+	}
+	ret := NewGenomes(orfs, 1)
+
+	fd, err := openInput(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
 
-	currentRow := make([]byte, 0)
-loop:
-	for {
-		line, err := fp.ReadString('\n')
-		switch err {
-		case io.EOF:
-			break loop
-		case nil:
-			break
-		default:
-			log.Fatal("Can't read file")
+	fp := bufio.NewReader(fd)
+	if detectAlignmentFormat(fp) == FASTA {
+		ret.names[0], ret.nts[0], err = NewFastaReader(fp, fname).Next()
+		if err == io.EOF {
+			return nil, loadError(fname, 0, "No sequences")
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		rows, err := readAlignment(fp, fname)
+		if err != nil {
+			return nil, err
 		}
+		if len(rows.names) == 0 {
+			return nil, loadError(fname, 0, "No sequences")
+		}
+		ret.names[0], ret.nts[0] = rows.names[0], rows.nts[0]
+	}
+
+	if err := ret.checkOrfs(orfsName); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+/*
+Load ORFs from a GFF3 file or one in our own .orfs format, going by the
+extension (without any .gz on the end).
+*/
+func loadAnyOrfs(fname string) (Orfs, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(fname, ".gz"), ".bgz")
+	switch filepath.Ext(base) {
+	case ".gff", ".gff3":
+		return LoadOrfsGFF3(fname)
+	}
+	return LoadOrfs(fname)
+}
 
-		line = strings.TrimSpace(line)
-
-		if strings.HasPrefix(line, ">") {
-			fields := strings.Fields(line[1:])
-			name := fields[0]
-			ret.names = append(ret.names, name)
-			if len(currentRow) > 0 {
-				ret.nts = append(ret.nts, currentRow)
-				currentRow = make([]byte, 0)
-			}
-			continue
+/*
+Check that all the ORFs fit in the first genome, and if it has gaps move
+them into the alignment's columns. This is also where they get
+OverrideCode if there is one, since every loader ends up here.
+*/
+func (g *Genomes) checkOrfs(orfsName string) error {
+	liftover := g.Liftover(0)
+	for _, orf := range g.orfs {
+		if orf.end > liftover.Length() {
+			return loadError(orfsName, orf.line,
+				"ORF %d-%d goes past the end of the genome (%d)",
+				orf.start+1, orf.end, liftover.Length())
 		}
+	}
 
-		currentRow = append(currentRow, []byte(line)...)
+	if g.HasGaps(0) {
+		g.orfs = liftover.ProjectOrfs(g.orfs)
 	}
-	ret.nts = append(ret.nts, currentRow)
-	return ret
+	if OverrideCode != nil {
+		g.orfs.SetGeneticCode(OverrideCode)
+	}
+	return nil
 }
 
+// Save just one of the genomes under the given name
 func (g *Genomes) Save(name, fname string, which int) error {
-	fd, err := os.Create(fname)
+	w, done, err := CreateFasta(fname, 60)
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
 
-	fp := bufio.NewWriter(fd)
-	fmt.Fprintf(fp, ">%s\n", name)
+	err = w.Write(name, nil, g.nts[which])
+	if doneErr := done(); err == nil {
+		err = doneErr
+	}
+	return err
+}
 
-	nts := g.nts[which]
-	ll := 60
-	var i int
-	for i = 0; i < len(nts)-ll; i += ll {
-		fmt.Fprintf(fp, "%s\n", string(nts[i:i+ll]))
+/*
+Save all the genomes, using their own names, as a multi-record FASTA file
+wrapped at width nts per line (0 means don't wrap). If metadata isn't nil
+there must be an entry for each genome, to go in its header.
+*/
+func (g *Genomes) SaveAll(fname string, width int,
+	metadata []FastaMetadata) error {
+	w, done, err := CreateFasta(fname, width)
+	if err != nil {
+		return err
 	}
 
-	fmt.Fprintf(fp, "%s\n", string(nts[i:]))
-	fp.Flush()
-	return nil
+	for i := 0; i < g.NumGenomes() && err == nil; i++ {
+		var m FastaMetadata
+		if metadata != nil {
+			m = metadata[i]
+		}
+		err = w.Write(g.names[i], m, g.nts[i])
+	}
+
+	if doneErr := done(); err == nil {
+		err = doneErr
+	}
+	return err
 }
 
 func (g *Genomes) Clone() *Genomes {
@@ -101,6 +237,8 @@ func (g *Genomes) Clone() *Genomes {
 		ret.nts[i] = make([]byte, len(g.nts[i]))
 		copy(ret.nts[i], g.nts[i])
 	}
+	copy(ret.names, g.names)
+	ret.shifts = append(ret.shifts, g.shifts...)
 	return ret
 }
 
@@ -111,6 +249,7 @@ shallow copy
 func (g *Genomes) Combine(other *Genomes) {
 	for i := 0; i < other.NumGenomes(); i++ {
 		g.nts = append(g.nts, other.nts[i])
+		g.names = append(g.names, other.names[i])
 	}
 }
 
@@ -125,3 +264,14 @@ func (g *Genomes) NumGenomes() int {
 func (g *Genomes) Length() int {
 	return len(g.nts[0])
 }
+
+// The nts with any gaps taken out
+func ungapped(nts []byte) []byte {
+	ret := make([]byte, 0, len(nts))
+	for _, nt := range nts {
+		if nt != '-' {
+			ret = append(ret, nt)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The columns we care about from a CDS line in a GFF3 file
+type gffCds struct {
+	start, end int // 0-based, end exclusive
+	strand     byte
+	phase      int
+	attributes map[string]string
+	line       int
+}
+
+func parseGffAttributes(s string) map[string]string {
+	ret := make(map[string]string)
+	for _, kv := range strings.Split(s, ";") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := url.PathUnescape(parts[1])
+		if err != nil {
+			value = parts[1]
+		}
+		ret[parts[0]] = value
+	}
+	return ret
+}
+
+/*
+Load the CDS features from a GFF3 file as Orfs. CDS lines with the same ID
+are segments of the same CDS (like ORF1ab with its frameshift), and the
+phase of the first one tells us where the first whole codon starts. If
+the file describes more than one sequence we only take the CDSs from the
+first one, since the Orfs belong to a single genome. CDSs with segments on
+both strands are skipped. Like LoadOrfs we give up if a CDS (once the phase
+is taken off) isn't a whole number of codons, and so does one whose strand
+isn't + or -.
+*/
+func LoadOrfsGFF3(fname string) (Orfs, error) {
+	fd, err := openInput(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	fp := bufio.NewReader(fd)
+
+	var seqId string
+	cdss := make(map[string][]gffCds)
+	ids := make([]string, 0) // So we can keep the order they came in
+
+	lineNum := 0
+loop:
+	for {
+		line, err := fp.ReadString('\n')
+		switch err {
+		case io.EOF:
+			if line == "" {
+				break loop
+			}
+		case nil:
+			break
+		default:
+			return nil, &LoadError{fname, lineNum, err}
+		}
+		lineNum++
+
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "##FASTA") {
+			break loop
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 9 {
+			return nil, loadError(fname, lineNum,
+				"Expected 9 tab-separated columns but got %d", len(fields))
+		}
+
+		if fields[2] != "CDS" {
+			continue
+		}
+
+		if seqId == "" {
+			seqId = fields[0]
+		} else if fields[0] != seqId {
+			continue
+		}
+
+		var cds gffCds
+		cds.line = lineNum
+		cds.start, err = strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, loadError(fname, lineNum,
+				"CDS start \"%s\" isn't a number", fields[3])
+		}
+		cds.start -= 1
+
+		cds.end, err = strconv.Atoi(fields[4])
+		if err != nil {
+			return nil, loadError(fname, lineNum,
+				"CDS end \"%s\" isn't a number", fields[4])
+		}
+
+		// We can't read a CDS without knowing which way round it goes
+		if fields[6] != "+" && fields[6] != "-" {
+			return nil, loadError(fname, lineNum,
+				"CDS strand \"%s\" isn't + or -", fields[6])
+		}
+		cds.strand = fields[6][0]
+		if fields[7] != "." {
+			cds.phase, err = strconv.Atoi(fields[7])
+			if err != nil || cds.phase < 0 || cds.phase > 2 {
+				return nil, loadError(fname, lineNum,
+					"Bad phase \"%s\"", fields[7])
+			}
+		}
+		cds.attributes = parseGffAttributes(fields[8])
+
+		// CDSs without an ID are one segment each
+		id, there := cds.attributes["ID"]
+		if !there {
+			id = fmt.Sprintf("line-%d-%d", cds.start, cds.end)
+		}
+
+		if _, there := cdss[id]; !there {
+			ids = append(ids, id)
+		}
+		cdss[id] = append(cdss[id], cds)
+	}
+
+	ret := make(Orfs, 0)
+
+cdss:
+	for _, id := range ids {
+		segments := cdss[id]
+		reverse := segments[0].strand == '-'
+		for _, cds := range segments {
+			if (cds.strand == '-') != reverse {
+				continue cdss
+			}
+		}
+
+		// The segments could be in any order in the file but we want them in
+		// the order they're read.
+		sort.Slice(segments, func(i, j int) bool {
+			if reverse {
+				return segments[i].start > segments[j].start
+			}
+			return segments[i].start < segments[j].start
+		})
+
+		orfSegments := make([]Segment, len(segments))
+		for i, cds := range segments {
+			orfSegments[i] = Segment{cds.start, cds.end}
+		}
+		if reverse {
+			orfSegments[0].end -= segments[0].phase
+		} else {
+			orfSegments[0].start += segments[0].phase
+		}
+
+		attributes := segments[0].attributes
+		orf := NewOrf(orfSegments, reverse)
+		orf.line = segments[0].line
+		if orf.Length()%3 != 0 {
+			return nil, loadError(fname, orf.line,
+				"ORF length %d isn't a multiple of 3", orf.Length())
+		}
+
+		if tt, there := attributes["transl_table"]; there {
+			id, err := strconv.Atoi(tt)
+			if err != nil {
+				return nil, loadError(fname, orf.line,
+					"Bad transl_table \"%s\"", tt)
+			}
+			orf.code, err = GetGeneticCode(id)
+			if err != nil {
+				return nil, &LoadError{fname, orf.line, err}
+			}
+		}
+
+		var there bool
+		orf.gene, there = attributes["gene"]
+		if !there {
+			orf.gene = attributes["Name"]
+		}
+		orf.product = attributes["product"]
+
+		ret = append(ret, orf)
+	}
+
+	sort.Sort(ret)
+	return ret, nil
+}
+
+// Escape the characters that have special meanings in GFF3 attributes
+func escapeGffValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ';', '=', '&', ',', '%', '\t', '\n', '\r':
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+/*
+Write the ORFs out as GFF3 CDS features on sequence seqId, which should be
+the name you passed to Genomes.Save so that genome browsers can match them
+up. Each segment gets its own line, with the same ID for the whole ORF.
+*/
+func (orfs Orfs) SaveGFF3(fname, seqId string, length int) error {
+	fd, err := createOutput(fname)
+	if err != nil {
+		return err
+	}
+
+	fp := bufio.NewWriter(fd)
+	fmt.Fprintln(fp, "##gff-version 3")
+	fmt.Fprintf(fp, "##sequence-region %s 1 %d\n", escapeGffValue(seqId),
+		length)
+
+	for i, orf := range orfs {
+		attributes := fmt.Sprintf("ID=cds-%d", i+1)
+		if orf.gene != "" {
+			attributes += fmt.Sprintf(";Name=%s;gene=%s",
+				escapeGffValue(orf.gene), escapeGffValue(orf.gene))
+		}
+		if orf.product != "" {
+			attributes += ";product=" + escapeGffValue(orf.product)
+		}
+		if orf.code != StandardCode {
+			attributes += fmt.Sprintf(";transl_table=%d", orf.code.id)
+		}
+
+		// The phase is how many nts to skip to get to the next whole codon,
+		// if the previous segments left us part of the way through one.
+		strand := '+'
+		if orf.reverse {
+			strand = '-'
+		}
+
+		orfPos := 0
+		for _, seg := range orf.segments {
+			phase := (3 - orfPos%3) % 3
+			fmt.Fprintf(fp, "%s\tmutations\tCDS\t%d\t%d\t.\t%c\t%d\t%s\n",
+				escapeGffValue(seqId), seg.start+1, seg.end, strand, phase,
+				attributes)
+			orfPos += seg.end - seg.start
+		}
+	}
+
+	err = fp.Flush()
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
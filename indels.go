@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+/*
+Move the ORFs to allow for n nts being inserted before pos (or deleted from
+pos onwards if n is negative). This makes new Orfs rather than changing
+them, since mutants share their ORFs with the genome they came from.
+*/
+func (orfs Orfs) shift(pos, n int) Orfs {
+	// Where x moves to. An insertion at the start of a segment goes before
+	// it and one at the end goes after it.
+	moveStart := func(x int) int {
+		switch {
+		case x < pos:
+			return x
+		case n > 0 || x >= pos-n:
+			return x + n
+		}
+		return pos
+	}
+	moveEnd := func(x int) int {
+		switch {
+		case x <= pos:
+			return x
+		case n > 0 || x >= pos-n:
+			return x + n
+		}
+		return pos
+	}
+
+	ret := make(Orfs, len(orfs))
+	for i, orf := range orfs {
+		segments := make([]Segment, len(orf.segments))
+		for j, seg := range orf.segments {
+			segments[j] = Segment{moveStart(seg.start), moveEnd(seg.end)}
+		}
+		ret[i] = orf.withSegments(segments)
+	}
+	return ret
+}
+
+// An indel of n nts at pos, the same as for Orfs.shift
+type shift struct {
+	pos, n int
+}
+
+// Insert nts before pos in the first genome, which should be the only one
+func (g *Genomes) InsertNts(pos int, nts []byte) {
+	row := make([]byte, 0, len(g.nts[0])+len(nts))
+	row = append(row, g.nts[0][:pos]...)
+	row = append(row, nts...)
+	g.nts[0] = append(row, g.nts[0][pos:]...)
+	g.orfs = g.orfs.shift(pos, len(nts))
+	g.shifts = append(g.shifts, shift{pos, len(nts)})
+}
+
+// Delete n nts from pos in the first genome, which should be the only one
+func (g *Genomes) DeleteNts(pos, n int) {
+	row := make([]byte, 0, len(g.nts[0])-n)
+	row = append(row, g.nts[0][:pos]...)
+	g.nts[0] = append(row, g.nts[0][pos+n:]...)
+	g.orfs = g.orfs.shift(pos, -n)
+	g.shifts = append(g.shifts, shift{pos, -n})
+}
+
+/*
+Where pos in the first genome has got to after all the indels InsertNts and
+DeleteNts have made in it (since it was loaded, or cloned from something
+that was), or false if it's been deleted.
+*/
+func (g *Genomes) MovePosition(pos int) (int, bool) {
+	for _, s := range g.shifts {
+		switch {
+		case pos < s.pos:
+		case s.n > 0 || pos >= s.pos-s.n:
+			pos += s.n
+		default:
+			return 0, false
+		}
+	}
+	return pos, true
+}
+
+/*
+Where indels happen and how long they are, from the gaps in alignments of
+WH1 with its relatives. Indels in ORFs are always a whole number of codons
+and go between codons, and ones outside them can be any length. The rates
+are how many indels there are for each substitution, counted the same way
+as the number of mutations for each genome (see CountMutations): silentRate
+for each silent one, for when those are all MutateSilent makes, and rate for
+each one in the ORFs, for when it keeps some non-silent ones too.
+*/
+type IndelModel struct {
+	silentRate float64
+	rate       float64
+	orfEvents  int      // How many indels there were in ORFs
+	events     int      // And in total
+	orfLengths [2][]int // Lengths of deletions and insertions in ORFs
+	lengths    [2][]int // And outside them
+	tables     [2][2]*aliasTable
+	nts        *NucDistro // What we insert
+}
+
+const (
+	indelDeletion = iota
+	indelInsertion
+)
+
+// Count a length, making room for it if need be
+func countLength(lengths []int, n int) []int {
+	for len(lengths) <= n {
+		lengths = append(lengths, 0)
+	}
+	lengths[n]++
+	return lengths
+}
+
+/*
+Fit an IndelModel to alignments of WH1 (the first row) with a relative (the
+second). A run of gaps in WH1 is an insertion in the relative, and a run of
+gaps in the relative is a deletion. Gaps at the ends don't count since
+they're usually just where sequencing stopped.
+*/
+func FitIndelModel(alignments []*Genomes) *IndelModel {
+	ret := IndelModel{nts: NewNucDistro(nil)}
+	silent, substitutions := 0, 0
+
+	for _, g := range alignments {
+		s, nonSilent := CountMutations(g)
+		silent += s
+		substitutions += s + nonSilent
+
+		n := g.Length()
+		first, last := n, -1
+		for j := 0; j < n; j++ {
+			if g.nts[0][j] != '-' && g.nts[1][j] != '-' {
+				if first == n {
+					first = j
+				}
+				last = j
+			}
+		}
+
+		for j := first; j <= last; {
+			a, b := g.nts[0][j], g.nts[1][j]
+			ret.nts.add(b)
+
+			var kind, row int
+			switch {
+			case a == '-':
+				kind, row = indelInsertion, 0
+			case b == '-':
+				kind, row = indelDeletion, 1
+			default:
+				j++
+				continue
+			}
+
+			start := j
+			for j <= last && g.nts[row][j] == '-' {
+				j++
+			}
+			length := j - start
+
+			// In an ORF if it's got the same ORF either side
+			k := g.orfs.Find(start - 1)
+			if k != -1 && g.orfs.Find(j) == k {
+				if length%3 != 0 {
+					// A frameshift, which we don't do
+					continue
+				}
+				ret.orfLengths[kind] = countLength(ret.orfLengths[kind],
+					length)
+				ret.orfEvents++
+			} else {
+				ret.lengths[kind] = countLength(ret.lengths[kind], length)
+			}
+			ret.events++
+		}
+	}
+	ret.nts.update()
+
+	if silent > 0 {
+		ret.silentRate = float64(ret.events) / float64(silent)
+	}
+	if substitutions > 0 {
+		ret.rate = float64(ret.events) / float64(substitutions)
+	}
+	ret.update()
+	return &ret
+}
+
+// Get ready to draw lengths from the counts
+func (m *IndelModel) update() {
+	for kind := 0; kind < 2; kind++ {
+		for i, lengths := range [][]int{m.orfLengths[kind],
+			m.lengths[kind]} {
+			weights := make([]float64, len(lengths))
+			for n, count := range lengths {
+				weights[n] = float64(count)
+			}
+			if len(weights) == 0 {
+				m.tables[i][kind] = nil
+				continue
+			}
+			m.tables[i][kind] = newAliasTable(nil, weights)
+		}
+	}
+}
+
+/*
+Try to make an indel at pos, with a length drawn for whether it's in an ORF
+or not. Indels in ORFs go at the start of the codon pos is in, and are
+only kept if they don't make any more problems for the ORFs they're in (see
+ValidateOrf), like a stop in an insertion. Returns whether we made one.
+*/
+func (m *IndelModel) tryIndel(genome *Genomes, pos int,
+	rng *rand.Rand) bool {
+	orfs := genome.orfs
+	inOrf := orfs.Find(pos) != -1
+
+	// Pick whether it's an insertion or deletion in proportion to how many
+	// of each there were
+	t := 1
+	if inOrf {
+		t = 0
+	}
+	var counts [2]int
+	for kind := 0; kind < 2; kind++ {
+		lengths := m.lengths[kind]
+		if inOrf {
+			lengths = m.orfLengths[kind]
+		}
+		for _, c := range lengths {
+			counts[kind] += c
+		}
+	}
+	if counts[0]+counts[1] == 0 {
+		return false
+	}
+	kind := indelDeletion
+	if rng.Intn(counts[0]+counts[1]) >= counts[0] {
+		kind = indelInsertion
+	}
+	length := m.tables[t][kind].drawIndex(rng)
+
+	if inOrf {
+		codonStart, _, err := orfs.GetCodonOffset(pos)
+		if err != nil {
+			return false
+		}
+		pos = codonStart
+		if orfs[orfs.Find(pos)].reverse {
+			// The codon goes leftwards from codonStart
+			pos -= 2
+		}
+
+		// Anything at the very start of the ORF (or of a segment of it)
+		// would end up in front of it
+		if orfs.Find(pos-1) != orfs.Find(pos) {
+			return false
+		}
+	}
+
+	nts := genome.nts[0]
+	if kind == indelDeletion {
+		if pos+length > len(nts) {
+			return false
+		}
+		for i := pos; i < pos+length; i++ {
+			if !inOrf && orfs.Find(i) != -1 {
+				return false
+			}
+		}
+	}
+
+	// The ORFs that could be affected, and how many problems they've got
+	before := make(map[int]int)
+	for i := range orfs {
+		if orfs[i].start <= pos+length && orfs[i].end >= pos {
+			before[i] = len(genome.ValidateOrf(i))
+		}
+	}
+
+	mutant := NewGenomes(orfs, 1)
+	mutant.nts[0] = nts
+	mutant.names[0] = genome.names[0]
+	mutant.shifts = genome.shifts
+	if kind == indelDeletion {
+		mutant.DeleteNts(pos, length)
+	} else {
+		insertion := make([]byte, length)
+		for i := range insertion {
+			insertion[i] = m.nts.Random(rng)
+		}
+		mutant.InsertNts(pos, insertion)
+	}
+
+	for i, n := range before {
+		if len(mutant.ValidateOrf(i)) > n {
+			return false
+		}
+	}
+
+	genome.nts[0], genome.orfs = mutant.nts[0], mutant.orfs
+	genome.shifts = mutant.shifts
+	return true
+}
+
+/*
+Make num indels in genome (which should only have one row) at random
+positions, and return how many we managed.
+*/
+func (m *IndelModel) Mutate(genome *Genomes, num int, rng *rand.Rand) int {
+	if m.events == 0 {
+		return 0
+	}
+
+	// Pick in ORFs or not in proportion to how many indels were, and then
+	// keep trying positions until one of those works. Like MutateSilent we
+	// give up if that takes too long.
+	ret := 0
+	for ret < num {
+		wantOrf := rng.Intn(m.events) < m.orfEvents
+		done := false
+		for failures := 0; !done && failures < 1000; failures++ {
+			pos := rng.Intn(genome.Length())
+			if (genome.orfs.Find(pos) != -1) == wantOrf {
+				done = m.tryIndel(genome, pos, rng)
+			}
+		}
+		if !done {
+			break
+		}
+		ret++
+	}
+	return ret
+}
+
+func (m *IndelModel) Show() {
+	fmt.Printf("Indels: %.4f per silent substitution, %.4f per substitution "+
+		"in ORFs, %d/%d in ORFs\n", m.silentRate, m.rate, m.orfEvents,
+		m.events)
+	names := [2]string{"Deletions", "Insertions"}
+	for kind := 0; kind < 2; kind++ {
+		fmt.Printf("%s in ORFs:", names[kind])
+		for n, c := range m.orfLengths[kind] {
+			if c > 0 {
+				fmt.Printf(" %d:%d", n, c)
+			}
+		}
+		fmt.Printf("\n%s outside ORFs:", names[kind])
+		for n, c := range m.lengths[kind] {
+			if c > 0 {
+				fmt.Printf(" %d:%d", n, c)
+			}
+		}
+		fmt.Println()
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+)
+
+/*
+Maps between the columns of an alignment and the positions in one of its
+genomes (i.e. ignoring gaps). When there aren't any gaps they're the same.
+*/
+type Liftover struct {
+	columns   []int // The column each position is in
+	positions []int // The position in each column, or -1 for a gap
+}
+
+// Make a Liftover for the genome in row which
+func (g *Genomes) Liftover(which int) *Liftover {
+	row := g.nts[which]
+	ret := Liftover{make([]int, 0, len(row)), make([]int, len(row))}
+	for col, nt := range row {
+		if nt == '-' {
+			ret.positions[col] = -1
+			continue
+		}
+		ret.positions[col] = len(ret.columns)
+		ret.columns = append(ret.columns, col)
+	}
+	return &ret
+}
+
+// Are there any gaps in row which?
+func (g *Genomes) HasGaps(which int) bool {
+	return bytes.IndexByte(g.nts[which], '-') != -1
+}
+
+// How long the genome is without its gaps
+func (l *Liftover) Length() int {
+	return len(l.columns)
+}
+
+// The column that pos is in
+func (l *Liftover) Column(pos int) int {
+	return l.columns[pos]
+}
+
+// The position in column col, and false if it's a gap
+func (l *Liftover) Position(col int) (int, bool) {
+	pos := l.positions[col]
+	return pos, pos != -1
+}
+
+/*
+The position in column col, or if it's a gap the one after it, which is
+what you want for something that starts at col (like a restriction site).
+Returns Length() if there are only gaps from col onwards.
+*/
+func (l *Liftover) PositionAtOrAfter(col int) int {
+	for ; col < len(l.positions); col++ {
+		if l.positions[col] != -1 {
+			return l.positions[col]
+		}
+	}
+	return l.Length()
+}
+
+/*
+Move ORFs from the genome's positions into the alignment's columns. Each
+segment is split wherever there are gaps, so that reading the ORF from the
+alignment skips them.
+*/
+func (l *Liftover) ProjectOrfs(orfs Orfs) Orfs {
+	ret := make(Orfs, len(orfs))
+	for i, orf := range orfs {
+		segments := make([]Segment, 0, len(orf.segments))
+		for _, seg := range orf.segments {
+			// Runs of consecutive columns, in order along the alignment
+			runs := make([]Segment, 0)
+			for pos := seg.start; pos < seg.end; pos++ {
+				col := l.columns[pos]
+				if len(runs) > 0 && runs[len(runs)-1].end == col {
+					runs[len(runs)-1].end++
+				} else {
+					runs = append(runs, Segment{col, col + 1})
+				}
+			}
+
+			if orf.reverse {
+				for j := len(runs) - 1; j >= 0; j-- {
+					segments = append(segments, runs[j])
+				}
+			} else {
+				segments = append(segments, runs...)
+			}
+		}
+		ret[i] = orf.withSegments(segments)
+	}
+	return ret
+}
+
+/*
+The opposite of ProjectOrfs: move ORFs from the alignment's columns into the
+genome's positions. Segments that end up next to each other are joined back
+together, but ones that overlap (like the frameshift in ORF1ab) aren't.
+*/
+func (l *Liftover) UnprojectOrfs(orfs Orfs) Orfs {
+	ret := make(Orfs, len(orfs))
+	for i, orf := range orfs {
+		segments := make([]Segment, 0, len(orf.segments))
+		for _, seg := range orf.segments {
+			start := l.PositionAtOrAfter(seg.start)
+			end := l.PositionAtOrAfter(seg.end)
+			if start >= end {
+				continue
+			}
+
+			if n := len(segments); n > 0 {
+				last := &segments[n-1]
+				if !orf.reverse && last.end == start {
+					last.end = end
+					continue
+				}
+				if orf.reverse && last.start == end {
+					last.start = start
+					continue
+				}
+			}
+			segments = append(segments, Segment{start, end})
+		}
+		ret[i] = orf.withSegments(segments)
+	}
+	return ret
+}
+
+// A copy of orf with different segments
+func (orf *Orf) withSegments(segments []Segment) Orf {
+	ret := NewOrf(segments, orf.reverse)
+	ret.code, ret.line = orf.code, orf.line
+	ret.gene, ret.product = orf.gene, orf.product
+	ret.name = orf.name
+	return ret
+}
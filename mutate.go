@@ -5,15 +5,55 @@ import (
 )
 
 /*
-Introduce num silent mutations into genome (the first one), selecting nts
-randomly from nucDist. Return the number of mutations
+How MutateSilent makes mutants: where the replacement nts come from, how
+likely each position is to be picked, which non-silent changes to keep
+(if selection is nil it only makes silent ones), and whether to make indels
+as well (if indels isn't nil).
 */
-func MutateSilent(genome *Genomes, nucDist *NucDistro, num int) int {
+type MutationParams struct {
+	model     NucleotideModel
+	rates     *SiteRates
+	selection *Selection
+	indels    *IndelModel
+}
+
+/*
+Introduce num silent mutations into genome (the first one), picking the
+positions and replacement nts as params says. Return the number of
+mutations. We never mutate an ambiguity code, and never mutate next to one
+if it's in the same codon (because Environment.Replace doesn't consider
+that silent). If params has a selection some of the mutations won't be
+silent, and this is a bit of a misnomer. If it has indels we then make
+about num times their rate of those too (which aren't counted), and the
+genome's ORFs move to allow for them.
+*/
+func MutateSilent(genome *Genomes, params *MutationParams, num int,
+	rng *rand.Rand) int {
+	return mutate(genome, params, num, false, rng)
+}
+
+/*
+Like MutateSilent, but instead of carrying on until there are num
+mutations, propose num of them at positions anywhere in genome and only
+keep the ones MutateSilent would have made. The rest are either somewhere
+MutateSilent never mutates (like outside the ORFs) or changes it would have
+thrown away, e.g. for not being silent. Return the number that were kept.
+This is what you want if num is from a branch length, since that counts
+substitutions at every site, whether or not selection got rid of them.
+*/
+func MutateProposals(genome *Genomes, params *MutationParams, num int,
+	rng *rand.Rand) int {
+	return mutate(genome, params, num, true, rng)
+}
+
+// Do the work for MutateSilent, or MutateProposals if proposals is true
+func mutate(genome *Genomes, params *MutationParams, num int,
+	proposals bool, rng *rand.Rand) int {
 	numMuts := 0
 	alreadyDone := make(map[int]int)
 	nts := genome.nts[0]
 
-	// Try to mutate silently at pos. Return true if we succeeded.
+	// Try to mutate at pos. Return true if we succeeded.
 	tryMutate := func(pos int) bool {
 		done, _ := alreadyDone[pos]
 		if done != 0 {
@@ -28,52 +68,83 @@ func MutateSilent(genome *Genomes, nucDist *NucDistro, num int) int {
 		}
 
 		existing := nts[pos]
+		if !isUnambiguous(existing) {
+			return false
+		}
+
 		var replacement byte
 		for {
-			replacement = nucDist.Random()
+			replacement = params.model.Draw(genome, pos, rng)
 			if replacement != existing {
 				break
 			}
 		}
 
-		silent, _ := env.Replace([]byte{replacement})
-		if silent {
+		var keep bool
+		if params.selection == nil {
+			keep, _ = env.Replace([]byte{replacement})
+		} else {
+			p := params.selection.Probability(genome, &env,
+				[]byte{replacement})
+			keep = rng.Float64() < p
+		}
+
+		if keep {
 			nts[pos] = replacement
 			alreadyDone[pos] = 1
 			numMuts++
 		}
-		return silent
+		return keep
 	}
 
-mutations:
-	for i := 0; i < num; {
-		start := rand.Intn(genome.Length())
+	positions, numSites := params.rates.positionTable(genome, params.model,
+		rng)
+	if positions == nil {
+		return 0
+	}
 
-		for j := start; j < genome.Length(); j++ {
-			if tryMutate(j) {
-				i++
-				continue mutations
+	if proposals {
+		// Each proposal lands on one of the positions we could mutate as
+		// often as it would if every position in the genome were as likely
+		// as any other, and is wasted otherwise
+		for i := 0; i < num; i++ {
+			if rng.Intn(genome.Length()) < numSites {
+				tryMutate(positions.drawIndex(rng))
 			}
 		}
-
-		for j := 0; j < start; j++ {
-			if tryMutate(j) {
-				i++
-				continue mutations
+	} else {
+		// We just keep drawing positions until one works, so that they're
+		// picked in proportion to their rates among the ones where a silent
+		// mutation is possible. If we fail this many times in a row there
+		// probably aren't any of those left, which shouldn't ever happen.
+		maxFailures := 100 * genome.Length()
+		for failures := 0; numMuts < num && failures < maxFailures; {
+			if tryMutate(positions.drawIndex(rng)) {
+				failures = 0
+			} else {
+				failures++
 			}
 		}
+	}
 
-		// If we get here it means we've wrapped around the whole genome and
-		// not found anywhere to put another silent mutation in. This shouldn't
-		// ever happen.
-		break
+	if params.indels != nil {
+		// numMuts is only silent ones unless there's a selection
+		rate := params.indels.silentRate
+		if params.selection != nil {
+			rate = params.indels.rate
+		}
+		params.indels.Mutate(genome, randPoisson(float64(numMuts)*rate, rng),
+			rng)
 	}
 	return numMuts
 }
 
 /*
 Returns the number of silent and non-silent mutations in an alignment of
-two genomes. Ignores indels.
+two genomes. Ignores indels and anything with an ambiguity code in either
+genome, since we can't know if it's really a mutation. Mutations in codons
+that have an ambiguity code elsewhere in them (in either genome) are
+skipped too, since we can't know if they're silent.
 */
 func CountMutations(genomes *Genomes) (int, int) {
 	var nonSilent, silent int
@@ -90,7 +161,7 @@ func CountMutations(genomes *Genomes) (int, int) {
 			continue
 		}
 
-		if a == '-' || b == '-' {
+		if !isUnambiguous(a) || !isUnambiguous(b) {
 			continue
 		}
 
@@ -99,6 +170,22 @@ func CountMutations(genomes *Genomes) (int, int) {
 			// Ignore anything not in an ORF
 			continue
 		}
+
+		// Gaps are fine, they just mean the codon's been split up
+		windowStart := env.start - env.offset
+		ambiguous := false
+		for _, c := range env.codons {
+			for _, nt := range []byte{a_nts[windowStart+c],
+				b_nts[windowStart+c]} {
+				if nt != '-' && !isUnambiguous(nt) {
+					ambiguous = true
+				}
+			}
+		}
+		if ambiguous {
+			continue
+		}
+
 		isSilent, _ := env.Replace(b_nts[i : i+1])
 
 		if isSilent {
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A node in a phylogenetic tree, with the length of the branch above it
+type TreeNode struct {
+	name     string
+	length   float64
+	children []*TreeNode
+}
+
+// All the nodes under (and including) n, parents before their children
+func (n *TreeNode) Nodes() []*TreeNode {
+	ret := []*TreeNode{n}
+	for _, c := range n.children {
+		ret = append(ret, c.Nodes()...)
+	}
+	return ret
+}
+
+func (n *TreeNode) IsTip() bool {
+	return len(n.children) == 0
+}
+
+type newickParser struct {
+	text string
+	pos  int
+}
+
+func (p *newickParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Newick character %d: %s", p.pos+1,
+		fmt.Sprintf(format, args...))
+}
+
+// Skip whitespace and [comments]
+func (p *newickParser) skip() error {
+	for p.pos < len(p.text) {
+		switch p.text[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		case '[':
+			end := strings.IndexByte(p.text[p.pos:], ']')
+			if end == -1 {
+				return p.errorf("Comment doesn't end")
+			}
+			p.pos += end + 1
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// The next character that isn't whitespace or a comment, or 0 at the end
+func (p *newickParser) peek() (byte, error) {
+	if err := p.skip(); err != nil {
+		return 0, err
+	}
+	if p.pos == len(p.text) {
+		return 0, nil
+	}
+	return p.text[p.pos], nil
+}
+
+/*
+A label, which is either in single quotes (doubled inside it) or runs
+until the next bit of punctuation. Newick says underscores in unquoted
+labels are spaces but we leave them alone, since genome names have them.
+*/
+func (p *newickParser) label() (string, error) {
+	c, err := p.peek()
+	if err != nil {
+		return "", err
+	}
+
+	if c == '\'' {
+		var ret strings.Builder
+		for p.pos++; p.pos < len(p.text); p.pos++ {
+			if p.text[p.pos] == '\'' {
+				if p.pos+1 < len(p.text) && p.text[p.pos+1] == '\'' {
+					ret.WriteByte('\'')
+					p.pos++
+					continue
+				}
+				p.pos++
+				return ret.String(), nil
+			}
+			ret.WriteByte(p.text[p.pos])
+		}
+		return "", p.errorf("Quoted label doesn't end")
+	}
+
+	start := p.pos
+	for ; p.pos < len(p.text); p.pos++ {
+		if strings.IndexByte("()[]':;, \t\r\n", p.text[p.pos]) != -1 {
+			break
+		}
+	}
+	return p.text[start:p.pos], nil
+}
+
+func (p *newickParser) node() (*TreeNode, error) {
+	var ret TreeNode
+
+	c, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	if c == '(' {
+		p.pos++
+		for {
+			child, err := p.node()
+			if err != nil {
+				return nil, err
+			}
+			ret.children = append(ret.children, child)
+
+			c, err = p.peek()
+			if err != nil {
+				return nil, err
+			}
+			p.pos++
+			if c == ')' {
+				break
+			}
+			if c == 0 {
+				return nil, errors.New("Newick tree ends too soon")
+			}
+			if c != ',' {
+				p.pos--
+				return nil, p.errorf("Expected , or ) but got %q", c)
+			}
+		}
+	}
+
+	ret.name, err = p.label()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err = p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if c == ':' {
+		p.pos++
+		if err := p.skip(); err != nil {
+			return nil, err
+		}
+		start := p.pos
+		for p.pos < len(p.text) &&
+			strings.IndexByte("0123456789.-+eE", p.text[p.pos]) != -1 {
+			p.pos++
+		}
+		ret.length, err = strconv.ParseFloat(p.text[start:p.pos], 64)
+		if err != nil || ret.length < 0 {
+			p.pos = start
+			return nil, p.errorf("Bad branch length")
+		}
+	}
+	return &ret, nil
+}
+
+// Parse a tree in Newick format, like "(A:0.1,(B:0.2,C:0.3):0.05);"
+func ParseNewick(text string) (*TreeNode, error) {
+	p := newickParser{text, 0}
+	ret, err := p.node()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if c != ';' {
+		return nil, p.errorf("Expected ; at the end")
+	}
+	p.pos++
+
+	c, err = p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if c != 0 {
+		return nil, errors.New("There's more than one tree")
+	}
+	return ret, nil
+}
+
+// Load a tree from a Newick file, which should only have one tree in it
+func LoadNewick(fname string) (*TreeNode, error) {
+	fd, err := openInput(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	text, err := io.ReadAll(fd)
+	if err != nil {
+		return nil, &LoadError{fname, 0, err}
+	}
+
+	ret, err := ParseNewick(string(text))
+	if err != nil {
+		return nil, &LoadError{fname, 0, err}
+	}
+	return ret, nil
+}
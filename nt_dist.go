@@ -5,41 +5,131 @@ import (
 	"math/rand"
 )
 
+// The nts we ever pick, in the order we list them
+const NTS = "ACGT"
+
+/*
+Picks from a fixed set of values with given weights in constant time, using
+Vose's alias method. Each of the n slots is picked with equal probability,
+and then either gives its own value or its alias. If values is nil you can
+still use drawIndex to pick which of the weights.
+*/
+type aliasTable struct {
+	values []byte
+	prob   []float64
+	alias  []int
+}
+
+// If all the weights are 0 every value is equally likely
+func newAliasTable(values []byte, weights []float64) *aliasTable {
+	n := len(weights)
+	ret := aliasTable{values, make([]float64, n), make([]int, n)}
+
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+
+	scaled := make([]float64, n)
+	small := make([]int, 0, n)
+	large := make([]int, 0, n)
+	for i, w := range weights {
+		if total > 0 {
+			scaled[i] = w * float64(n) / total
+		} else {
+			scaled[i] = 1
+		}
+		if scaled[i] < 1 {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+
+	for len(small) > 0 && len(large) > 0 {
+		s, l := small[len(small)-1], large[len(large)-1]
+		small, large = small[:len(small)-1], large[:len(large)-1]
+
+		ret.prob[s], ret.alias[s] = scaled[s], l
+		scaled[l] -= 1 - scaled[s]
+		if scaled[l] < 1 {
+			small = append(small, l)
+		} else {
+			large = append(large, l)
+		}
+	}
+
+	// Whatever's left is only off 1 by rounding
+	for _, i := range append(small, large...) {
+		ret.prob[i], ret.alias[i] = 1, i
+	}
+	return &ret
+}
+
+func (t *aliasTable) drawIndex(rng *rand.Rand) int {
+	i := rng.Intn(len(t.prob))
+	if rng.Float64() < t.prob[i] {
+		return i
+	}
+	return t.alias[i]
+}
+
+func (t *aliasTable) draw(rng *rand.Rand) byte {
+	return t.values[t.drawIndex(rng)]
+}
+
 // Counts for each nucleotide in a genome
 type NucDistro struct {
 	nts   map[byte]int
 	total int
+	table *aliasTable
 }
 
+/*
+Count the nts in g. Ambiguity codes (and gaps) aren't counted, so we never
+pick them as replacements.
+*/
 func (nd *NucDistro) Count(g *Genomes) {
 	for i := 0; i < g.NumGenomes(); i++ {
 		for j := 0; j < g.Length(); j++ {
-			nt := g.nts[i][j]
-
-			switch nt {
-			case 'R':
-				fallthrough
-			case 'Y':
-				continue
-			}
-
-			count, _ := nd.nts[nt]
-			nd.nts[nt] = count + 1
-			nd.total += 1
+			nd.add(g.nts[i][j])
 		}
 	}
+	nd.update()
+}
+
+// Count one nt. You need to call update when you've finished.
+func (nd *NucDistro) add(nt byte) {
+	if !isUnambiguous(nt) {
+		return
+	}
+	count, _ := nd.nts[nt]
+	nd.nts[nt] = count + 1
+	nd.total += 1
+}
+
+// Get ready to pick nts from the current counts
+func (nd *NucDistro) update() {
+	weights := make([]float64, len(NTS))
+	for i := 0; i < len(NTS); i++ {
+		weights[i] = float64(nd.nts[NTS[i]])
+	}
+	nd.table = newAliasTable([]byte(NTS), weights)
 }
 
 func NewNucDistro(g *Genomes) *NucDistro {
 	ret := NucDistro{nts: make(map[byte]int)}
 	if g != nil {
 		ret.Count(g)
+	} else {
+		ret.update()
 	}
 	return &ret
 }
 
 func (nd *NucDistro) Show() {
-	for k := range nd.nts {
+	for i := 0; i < len(NTS); i++ {
+		k := NTS[i]
 		fmt.Printf("%c: %d %.2f%%\n", k, nd.nts[k],
 			float64(100.0*nd.nts[k])/float64(nd.total))
 	}
@@ -49,14 +139,11 @@ func (nd *NucDistro) Show() {
 /*
 Pick a nucleotide randomly from the distribution represented by nd
 */
-func (nd *NucDistro) Random() byte {
-	r := rand.Intn(nd.total)
+func (nd *NucDistro) Random(rng *rand.Rand) byte {
+	return nd.table.draw(rng)
+}
 
-	var k byte
-	for k = range nd.nts {
-		if r < nd.nts[k] {
-			break
-		}
-	}
-	return k
+// NucDistro is a NucleotideModel that doesn't care where the nt goes
+func (nd *NucDistro) Draw(genome *Genomes, pos int, rng *rand.Rand) byte {
+	return nd.Random(rng)
 }
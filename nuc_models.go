@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+/*
+Where MutateSilent gets its replacement nts from. Draw picks one to put at
+pos in the first genome (it might pick the one that's already there, in
+which case MutateSilent just asks again).
+*/
+type NucleotideModel interface {
+	Draw(genome *Genomes, pos int, rng *rand.Rand) byte
+	Show()
+}
+
+/*
+A NucleotideModel that has a say in which positions mutate as well, like
+ContextModel. WeightPositions multiplies the weights SiteRates gave each
+position in the first genome by its own.
+*/
+type PositionWeighter interface {
+	WeightPositions(genome *Genomes, weights []float64)
+}
+
+// Which ORF pos is in (the first one if it's in more than one), or -1
+func (orfs Orfs) Find(pos int) int {
+	for i := 0; i < len(orfs); i++ {
+		if orfs[i].Contains(pos) {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+The composition of each codon position separately (in the first ORF a
+position is in), since the third positions of codons tend to be quite
+different from the others. Anything outside the ORFs uses the overall
+composition.
+*/
+type CodonPositionModel struct {
+	positions [3]*NucDistro
+	other     *NucDistro
+}
+
+func NewCodonPositionModel(genomes []*Genomes) *CodonPositionModel {
+	var ret CodonPositionModel
+	for i := 0; i < 3; i++ {
+		ret.positions[i] = NewNucDistro(nil)
+	}
+	ret.other = NewNucDistro(nil)
+
+	for _, g := range genomes {
+		for j := 0; j < g.Length(); j++ {
+			nd := ret.other
+			_, offset, err := g.orfs.GetCodonOffset(j)
+			if err == nil {
+				nd = ret.positions[offset]
+			}
+			for i := 0; i < g.NumGenomes(); i++ {
+				nd.add(g.nts[i][j])
+			}
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		ret.positions[i].update()
+	}
+	ret.other.update()
+	return &ret
+}
+
+func (m *CodonPositionModel) Draw(genome *Genomes, pos int,
+	rng *rand.Rand) byte {
+	_, offset, err := genome.orfs.GetCodonOffset(pos)
+	if err != nil {
+		return m.other.Random(rng)
+	}
+	return m.positions[offset].Random(rng)
+}
+
+func (m *CodonPositionModel) Show() {
+	for i := 0; i < 3; i++ {
+		fmt.Printf("Codon position %d:\n", i+1)
+		m.positions[i].Show()
+	}
+	fmt.Println("Outside ORFs:")
+	m.other.Show()
+}
+
+/*
+The composition of each ORF separately. ORFs are matched up between genomes
+by orfKey, so the genomes need to have been through MatchOrfs for ORFs
+without gene names to line up. Anything outside the ORFs uses the overall
+composition.
+*/
+type OrfModel struct {
+	orfs  map[string]*NucDistro
+	other *NucDistro
+}
+
+/*
+What we call an ORF when we match it up with the ones in other genomes,
+which is what MatchOrfs found it to be in WH1 if it's been matched, or its
+gene name, or ORF1, ORF2 etc. in the order they were listed. Only the first
+is any good for genomes other than WH1, since their .orfs files don't all
+have the same ORFs (BtSY2 has an extra one and RaTG13 is missing one).
+*/
+func orfKey(orfs Orfs, i int) string {
+	if orfs[i].name != "" {
+		return orfs[i].name
+	}
+	if orfs[i].gene != "" {
+		return orfs[i].gene
+	}
+	return fmt.Sprintf("ORF%d", i+1)
+}
+
+/*
+Name each of g's ORFs after the one of WH1's it corresponds to, using
+alignment, which is WH1 and then g with WH1's ORFs (as LoadWH1Alignment
+gives you). They correspond if they're on the same strand and overlap by at
+least half the length of the longer one in the alignment. An ORF that
+doesn't correspond to any of WH1's gets a name with g's name in it, so it
+doesn't get mixed up with anything.
+*/
+func (g *Genomes) MatchOrfs(alignment *Genomes) error {
+	liftover := alignment.Liftover(1)
+	if liftover.Length() != g.Length() {
+		return fmt.Errorf("%s is length %d but it's length %d in its "+
+			"alignment with WH1", g.names[0], g.Length(),
+			liftover.Length())
+	}
+	projected := liftover.ProjectOrfs(g.orfs)
+
+	for i := range g.orfs {
+		orf := &projected[i]
+		best, bestOverlap := -1, 0
+		for j := range alignment.orfs {
+			wh1Orf := &alignment.orfs[j]
+			if wh1Orf.reverse != orf.reverse {
+				continue
+			}
+
+			start, end := orf.start, orf.end
+			if wh1Orf.start > start {
+				start = wh1Orf.start
+			}
+			if wh1Orf.end < end {
+				end = wh1Orf.end
+			}
+			longer := orf.end - orf.start
+			if wh1Orf.end-wh1Orf.start > longer {
+				longer = wh1Orf.end - wh1Orf.start
+			}
+			if overlap := end - start; 2*overlap >= longer &&
+				overlap > bestOverlap {
+				best, bestOverlap = j, overlap
+			}
+		}
+
+		if best != -1 {
+			g.orfs[i].name = orfKey(alignment.orfs, best)
+		} else {
+			g.orfs[i].name = fmt.Sprintf("%s:ORF%d", g.names[0], i+1)
+		}
+	}
+	return nil
+}
+
+func NewOrfModel(genomes []*Genomes) *OrfModel {
+	ret := OrfModel{make(map[string]*NucDistro), NewNucDistro(nil)}
+
+	for _, g := range genomes {
+		for j := 0; j < g.Length(); j++ {
+			nd := ret.other
+			if k := g.orfs.Find(j); k != -1 {
+				key := orfKey(g.orfs, k)
+				nd = ret.orfs[key]
+				if nd == nil {
+					nd = NewNucDistro(nil)
+					ret.orfs[key] = nd
+				}
+			}
+			for i := 0; i < g.NumGenomes(); i++ {
+				nd.add(g.nts[i][j])
+			}
+		}
+	}
+
+	for _, nd := range ret.orfs {
+		nd.update()
+	}
+	ret.other.update()
+	return &ret
+}
+
+func (m *OrfModel) Draw(genome *Genomes, pos int, rng *rand.Rand) byte {
+	k := genome.orfs.Find(pos)
+	if k == -1 {
+		return m.other.Random(rng)
+	}
+
+	// An ORF none of the genomes we counted had
+	nd, there := m.orfs[orfKey(genome.orfs, k)]
+	if !there {
+		nd = m.other
+	}
+	return nd.Random(rng)
+}
+
+func (m *OrfModel) Show() {
+	keys := make([]string, 0, len(m.orfs))
+	for k := range m.orfs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Printf("%s:\n", k)
+		m.orfs[k].Show()
+	}
+	fmt.Println("Outside ORFs:")
+	m.other.Show()
+}
+
+/*
+Make one of the models from the nts in genomes. name is "empirical" (the
+overall composition), "codon-position" or "orf", or one of the substitution
+models "jc69", "k80", "hky85" or "gtr", or "context" (a trinucleotide
+context model). All but jc69 of those are fitted to the alignments of WH1
+with its relatives.
+*/
+func NewNucleotideModel(name string,
+	genomes, alignments []*Genomes) (NucleotideModel, error) {
+	switch name {
+	case "empirical":
+		nd := NewNucDistro(nil)
+		for _, g := range genomes {
+			nd.Count(g)
+		}
+		return nd, nil
+	case "codon-position":
+		return NewCodonPositionModel(genomes), nil
+	case "orf":
+		return NewOrfModel(genomes), nil
+	case "jc69":
+		return NewJC69(), nil
+	case "k80":
+		return FitK80(alignments), nil
+	case "hky85":
+		return FitHKY85(alignments), nil
+	case "gtr":
+		return FitGTR(alignments), nil
+	case "context":
+		return ContextModelFromSpectrum(FitSpectrum(alignments)), nil
+	}
+	return nil, fmt.Errorf("Unknown nucleotide model \"%s\"", name)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// From column start onwards (until the next one) a chimera is from parent
+type MosaicSegment struct {
+	start  int // Column in the alignment of the parents
+	parent int // Which row
+}
+
+/*
+Which parent each part of a chimera comes from, in order along the
+alignment. The first segment starts at column 0.
+*/
+type Mosaic []MosaicSegment
+
+// Something like 1:RaTG13,5000:BANAL-20-52 with positions in the first row
+func (m Mosaic) Describe(parents *Genomes) string {
+	liftover := parents.Liftover(0)
+	ret := make([]string, len(m))
+	for i, seg := range m {
+		ret[i] = fmt.Sprintf("%d:%s", liftover.PositionAtOrAfter(seg.start)+1,
+			parents.names[seg.parent])
+	}
+	return strings.Join(ret, ",")
+}
+
+/*
+Make a chimera from an alignment of its parents. The ORFs of the alignment
+(which should be the first row's) are moved onto the chimera, keeping each
+nt in the frame of the parent it came from.
+*/
+func Recombine(parents *Genomes, mosaic Mosaic, name string) *Genomes {
+	gapped := NewGenomes(parents.orfs, 1)
+	gapped.nts[0] = make([]byte, 0, parents.Length())
+	for i, seg := range mosaic {
+		end := parents.Length()
+		if i+1 < len(mosaic) {
+			end = mosaic[i+1].start
+		}
+		gapped.nts[0] = append(gapped.nts[0],
+			parents.nts[seg.parent][seg.start:end]...)
+	}
+
+	ret := NewGenomes(mosaicOrfs(parents, mosaic, gapped.nts[0]), 1)
+	ret.nts[0] = ungapped(gapped.nts[0])
+	ret.names[0] = name
+	return ret
+}
+
+/*
+Move the parents' ORFs (which are in alignment columns) onto a chimera,
+given it lined up with them. Each nt is read in the frame of the parent it
+came from, which is how many nts that parent has had in the ORF so far.
+Where a parent has an indel that isn't a whole number of codons the nts
+after it are out of step with the ORF, and they're skipped until the frames
+line up again rather than reading codons across the shift. The ORFs are
+trimmed to a whole number of codons, and ones that end up empty are left
+out.
+*/
+func mosaicOrfs(parents *Genomes, mosaic Mosaic, chimera []byte) Orfs {
+	// Which parent each column comes from, and where it is in the chimera
+	rows := make([]int, len(chimera))
+	positions := make([]int, len(chimera))
+	pos := 0
+	for i, seg := range mosaic {
+		end := len(chimera)
+		if i+1 < len(mosaic) {
+			end = mosaic[i+1].start
+		}
+		for col := seg.start; col < end; col++ {
+			rows[col], positions[col] = seg.parent, -1
+			if chimera[col] != '-' {
+				positions[col] = pos
+				pos++
+			}
+		}
+	}
+
+	ret := make(Orfs, 0, len(parents.orfs))
+	for _, orf := range parents.orfs {
+		counts := make([]int, parents.NumGenomes())
+		kept := make([]int, 0, orf.Length())
+		for offset := 0; offset < orf.Length(); offset++ {
+			col := orf.PosAt(offset)
+			frame := counts[rows[col]] % 3
+			for i := range counts {
+				if parents.nts[i][col] != '-' {
+					counts[i]++
+				}
+			}
+			if positions[col] != -1 && len(kept)%3 == frame {
+				kept = append(kept, positions[col])
+			}
+		}
+		kept = kept[:len(kept)-len(kept)%3]
+		if len(kept) == 0 {
+			continue
+		}
+
+		// Runs of consecutive positions, in the order they're read
+		segments := make([]Segment, 0, len(orf.segments))
+		for _, pos := range kept {
+			if n := len(segments); n > 0 {
+				last := &segments[n-1]
+				if !orf.reverse && last.end == pos {
+					last.end++
+					continue
+				}
+				if orf.reverse && last.start == pos+1 {
+					last.start--
+					continue
+				}
+			}
+			segments = append(segments, Segment{pos, pos + 1})
+		}
+		ret = append(ret, orf.withSegments(segments))
+	}
+	return ret
+}
+
+/*
+A random mosaic with numBreakpoints breakpoints, anywhere in the alignment.
+Each segment comes from one of the parents other than the first row (which
+is WH1 in alignment.fasta), but never the same one as the segment before.
+*/
+func RandomMosaic(parents *Genomes, numBreakpoints int,
+	rng *rand.Rand) Mosaic {
+	numParents := parents.NumGenomes() - 1
+	if numParents < 2 {
+		numBreakpoints = 0
+	}
+
+	starts := make([]int, 0, numBreakpoints+1)
+	used := make(map[int]bool)
+	for len(starts) < numBreakpoints {
+		col := 1 + rng.Intn(parents.Length()-1)
+		if !used[col] {
+			starts = append(starts, col)
+			used[col] = true
+		}
+	}
+	starts = append(starts, 0)
+	sort.Ints(starts)
+
+	ret := make(Mosaic, len(starts))
+	for i, start := range starts {
+		parent := 1 + rng.Intn(numParents)
+		for i > 0 && parent == ret[i-1].parent {
+			parent = 1 + rng.Intn(numParents)
+		}
+		ret[i] = MosaicSegment{start, parent}
+	}
+	return ret
+}
+
+/*
+Load a mosaic from a file where each line is the 1-based position in the
+first row of the parents where a segment starts and the name of its parent.
+The first one has to start at 1.
+*/
+func LoadMosaic(fname string, parents *Genomes) (Mosaic, error) {
+	fd, err := openInput(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	rows := make(map[string]int)
+	for i, name := range parents.names {
+		rows[name] = i
+	}
+	liftover := parents.Liftover(0)
+
+	ret := make(Mosaic, 0)
+	err = forEachLine(bufio.NewReader(fd), fname,
+		func(line string, lineNum int) error {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				return nil
+			}
+			if len(fields) != 2 {
+				return loadError(fname, lineNum,
+					"Expected a position and a parent but got %d fields",
+					len(fields))
+			}
+
+			pos, err := strconv.Atoi(fields[0])
+			if err != nil || pos < 1 || pos > liftover.Length() {
+				return loadError(fname, lineNum,
+					"Position \"%s\" isn't in %s", fields[0],
+					parents.names[0])
+			}
+			parent, there := rows[fields[1]]
+			if !there {
+				return loadError(fname, lineNum, "No parent called \"%s\"",
+					fields[1])
+			}
+
+			col := liftover.Column(pos - 1)
+			if len(ret) == 0 && pos != 1 {
+				return loadError(fname, lineNum,
+					"The first segment has to start at 1")
+			}
+			if len(ret) > 0 && col <= ret[len(ret)-1].start {
+				return loadError(fname, lineNum,
+					"Segments have to be in order")
+			}
+
+			// So that anything in gaps before the first position is included
+			if len(ret) == 0 {
+				col = 0
+			}
+			ret = append(ret, MosaicSegment{col, parent})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, &LoadError{fname, 0, errors.New("No segments")}
+	}
+	return ret, nil
+}
+
+type RecombinationTrial struct {
+	runFunc func(genome *Genomes, numMuts int, firstTrial int,
+		rng *rand.Rand, results chan interface{})
+}
+
+func (t *RecombinationTrial) Run(genome *Genomes, numMuts int,
+	firstTrial int, rng *rand.Rand, results chan interface{}) {
+	t.runFunc(genome, numMuts, firstTrial, rng, results)
+}
+
+func (t *RecombinationTrial) WriteHeadings(w io.Writer) {
+	fmt.Fprintln(w, "# Results from a Recombination Trial")
+	fmt.Fprintln(w, "name seed count max_length unique acceptable"+
+		" num_muts mutant_max_length mutant_acceptable mosaic")
+}
+
+type RecombinationTrialResult struct {
+	name             string // genome whose number of muts we used
+	seed             int64  // what the trial was seeded with
+	count            int    // number of sites in the chimera
+	maxLength        int    // length of its longest segment
+	unique           bool   // unique sticky ends?
+	acceptable       bool   // longest segment < 8kb and unique sticky?
+	numMuts          int    // How many muts we then did
+	mutantMaxLength  int    // longest segment in the mutant
+	mutantAcceptable bool   // and whether that was acceptable
+	mosaic           string // Where the chimera came from
+}
+
+func (r *RecombinationTrialResult) Write(w io.Writer) {
+	fmt.Fprintln(w, r.name, r.seed, r.count, r.maxLength, r.unique,
+		r.acceptable, r.numMuts, r.mutantMaxLength, r.mutantAcceptable,
+		r.mosaic)
+}
+
+/*
+Make numTrials random chimeras of parents with numBreakpoints breakpoints,
+look at their restriction maps, then mutate them with numMuts mutations
+(the same number as genome would get) and look again. That way you can see
+how a hand-made chimera like ChimericAncestor compares with random ones.
+*/
+func RecombinationTrials(genome *Genomes, parents *Genomes,
+	numBreakpoints int, params *MutationParams, numTrials int, numMuts int,
+	rng *rand.Rand, results chan interface{}) {
+	good := 0
+
+	reportProgress := func(n int) {
+		fmt.Printf("Chimeras (%d muts like %s): tested %d. Found %d/%d "+
+			"good mutants\n", numMuts, genome.names[0], n, good, n)
+	}
+
+	for i := 0; i < numTrials; i++ {
+		seed, trialRng := nextTrialRand(rng)
+		mosaic := RandomMosaic(parents, numBreakpoints, trialRng)
+		chimera := Recombine(parents, mosaic, "Chimera")
+
+		count, maxLength, unique, _, _ := FindRestrictionMap(chimera)
+		result := RecombinationTrialResult{name: genome.names[0], seed: seed,
+			count: count, maxLength: maxLength, unique: unique,
+			acceptable: unique && maxLength < 8000, numMuts: numMuts,
+			mosaic: mosaic.Describe(parents)}
+
+		MutateSilent(chimera, params, numMuts, trialRng)
+		_, maxLength, unique, _, _ = FindRestrictionMap(chimera)
+		result.mutantMaxLength = maxLength
+		result.mutantAcceptable = unique && maxLength < 8000
+		if result.mutantAcceptable {
+			good++
+		}
+
+		results <- &result
+
+		if i%100 == 0 {
+			reportProgress(i)
+		}
+	}
+
+	reportProgress(numTrials)
+}
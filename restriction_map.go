@@ -43,6 +43,12 @@ func getStickyEnd(genome *Genomes, pos int, site *ReSite) (string, error) {
 	}
 
 	s := genome.nts[0][start:end]
+	for _, nt := range s {
+		if !isUnambiguous(nt) {
+			return "", errors.New("Ambiguous")
+		}
+	}
+
 	if site.reverse {
 		s = reverse(s)
 	}
@@ -61,6 +67,13 @@ sticky ends are all unique, whether there is interleaving, and the
 positions of the sites. Note: I doubt interleaving has any significance but
 it's something people ask about so we might as well generate a result for
 them.
+
+Sites only match unambiguous nts, so a site with an ambiguity code in it
+doesn't count. If a sticky end has one in it we can't say whether it's
+unique, so we leave it out of that check, the same as one that runs off the
+end of the genome.
+If it's an alignment and the first genome has gaps, the positions and
+lengths are in that genome rather than in the alignment's columns.
 */
 func FindRestrictionMap(genome *Genomes) (int, int, bool, bool, []int) {
 	var s Search
@@ -117,5 +130,28 @@ func FindRestrictionMap(genome *Genomes) (int, int, bool, bool, []int) {
 	}
 	count++
 
+	if genome.HasGaps(0) {
+		maxLength = genomeLengths(genome.Liftover(0), positions)
+	}
+
 	return count, maxLength, unique, interleaved, positions
 }
+
+/*
+Move positions from columns to the first genome's positions in place, and
+return the length of the longest segment between them there.
+*/
+func genomeLengths(liftover *Liftover, positions []int) int {
+	prev, maxLength := 0, 0
+	for i, col := range positions {
+		positions[i] = liftover.PositionAtOrAfter(col)
+		if positions[i]-prev > maxLength {
+			maxLength = positions[i] - prev
+		}
+		prev = positions[i]
+	}
+	if liftover.Length()-prev > maxLength {
+		maxLength = liftover.Length() - prev
+	}
+	return maxLength
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"math/rand"
+)
+
+// One step of Vigna's SplitMix64, which turns a counter into a good seed
+func splitMix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+/*
+The seed for the i'th of several generators made from seed. Neighbouring
+seeds from rand.NewSource can give similar streams, so we mix them up
+first.
+*/
+func deriveSeed(seed int64, i int) int64 {
+	x := splitMix64(uint64(seed))
+	return int64(splitMix64(x+uint64(i)) >> 1)
+}
+
+/*
+Pick the seed for the next trial from rng (which belongs to whoever's running
+the trials) and make a generator for the trial from it. Everything random in
+a trial comes from that, so the seed is all you need to do it again.
+*/
+func nextTrialRand(rng *rand.Rand) (int64, *rand.Rand) {
+	seed := rng.Int63()
+	return seed, rand.New(rand.NewSource(seed))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+/*
+Grantham's (1974) composition, polarity and volume for each amino acid. His
+distances are worked out from these, and doing it ourselves gives his table
+back to within rounding.
+*/
+var granthamProperties = map[byte][3]float64{
+	'S': {1.42, 9.2, 32}, 'R': {0.65, 10.5, 124}, 'L': {0, 4.9, 111},
+	'P': {0.39, 8.0, 32.5}, 'T': {0.71, 8.6, 61}, 'A': {0, 8.1, 31},
+	'V': {0, 5.9, 84}, 'G': {0.74, 9.0, 3}, 'I': {0, 5.2, 111},
+	'F': {0, 5.2, 132}, 'Y': {0.20, 6.2, 136}, 'C': {2.75, 5.5, 55},
+	'H': {0.58, 10.4, 96}, 'Q': {0.89, 10.5, 85}, 'N': {1.33, 11.6, 56},
+	'K': {0.33, 11.3, 119}, 'D': {1.38, 13.0, 54}, 'E': {0.92, 12.3, 83},
+	'M': {0, 5.7, 105}, 'W': {0.13, 5.4, 170},
+}
+
+// The Grantham distance between two amino acids (0 to 215)
+func Grantham(a, b byte) float64 {
+	pa, ok := granthamProperties[a]
+	pb, ok2 := granthamProperties[b]
+	if !ok || !ok2 {
+		return 100
+	}
+	c, p, v := pa[0]-pb[0], pa[1]-pb[1], pa[2]-pb[2]
+	return 50.723 * math.Sqrt(1.833*c*c+0.1018*p*p+0.000399*v*v)
+}
+
+/*
+How readily one amino acid changes into another, relative to other changes.
+Grantham distances become exp(-d/100) so that similar amino acids swap more
+easily, and BLOSUM62 scores (which are in half-bits) become odds.
+*/
+func aaExchangeability(matrix string, a, b byte) float64 {
+	switch matrix {
+	case "grantham":
+		return math.Exp(-Grantham(a, b) / 100)
+	case "blosum62":
+		return math.Pow(2, float64(Blosum62(a, b))/2)
+	}
+	return 1
+}
+
+/*
+Which non-silent changes MutateSilent keeps. A change to a codon that alters
+its amino acid is kept with probability omega times the exchangeability of
+the two amino acids, where the exchangeabilities are scaled to average 1
+over all the amino acid changes a single nt can make in the ORF's genetic
+code. So omega is the dN/dS we're aiming for. Changes that make or lose a
+stop, or change the amino acid of a start codon, are never kept, and where
+a change is in more than one codon (because ORFs overlap) the
+probabilities are multiplied.
+
+If that would make some probabilities more than 1 we scale everything
+(including silent changes) down so that the largest is 1, which keeps the
+ratios right.
+*/
+type Selection struct {
+	omega     float64
+	orfOmegas map[string]float64 // By orfKey, instead of omega
+	matrix    string             // "", "grantham" or "blosum62"
+	weights   [256][256]float64  // Exchangeabilities
+	means     map[*GeneticCode]float64
+	scale     float64 // What we divide probabilities by
+}
+
+/*
+The mean and largest exchangeability over every single nt change between
+sense codons that changes the amino acid in code, which are the only ones
+we'll be asked about.
+*/
+func exchangeabilityStats(matrix string,
+	code *GeneticCode) (float64, float64) {
+	total, maxWeight, n := 0.0, 0.0, 0
+	codon := make([]byte, 3)
+	for i := 0; i < 64; i++ {
+		for j := 0; j < 3; j++ {
+			codon[j] = NTS[(i>>(2*(2-j)))&3]
+		}
+		a := code.Translate(codon)
+		if a == '*' {
+			continue
+		}
+
+		for j := 0; j < 3; j++ {
+			orig := codon[j]
+			for k := 0; k < 4; k++ {
+				codon[j] = NTS[k]
+				b := code.Translate(codon)
+				if b != a && b != '*' {
+					w := aaExchangeability(matrix, a, b)
+					total += w
+					if w > maxWeight {
+						maxWeight = w
+					}
+					n++
+				}
+			}
+			codon[j] = orig
+		}
+	}
+	return total / float64(n), maxWeight
+}
+
+/*
+Make a Selection. matrix is "grantham", "blosum62" or "" to treat all amino
+acid changes the same.
+*/
+func NewSelection(omega float64, orfOmegas map[string]float64,
+	matrix string) (*Selection, error) {
+	switch matrix {
+	case "", "grantham", "blosum62":
+		break
+	default:
+		return nil, fmt.Errorf("Unknown amino acid matrix \"%s\"", matrix)
+	}
+
+	ret := Selection{omega: omega, orfOmegas: orfOmegas, matrix: matrix,
+		means: make(map[*GeneticCode]float64)}
+
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			ret.weights[a][b] = aaExchangeability(matrix, byte(a), byte(b))
+		}
+	}
+
+	// Every code up front, since the ORFs could have any of them and we
+	// get used from lots of threads at once
+	maxWeight := 0.0
+	for _, code := range GeneticCodes {
+		mean, max := exchangeabilityStats(matrix, code)
+		ret.means[code] = mean
+		if max/mean > maxWeight {
+			maxWeight = max / mean
+		}
+	}
+
+	maxOmega := omega
+	for _, o := range orfOmegas {
+		if o > maxOmega {
+			maxOmega = o
+		}
+	}
+	ret.scale = maxOmega * maxWeight
+	if ret.scale < 1 {
+		ret.scale = 1
+	}
+	return &ret, nil
+}
+
+// The omega for the ORF, which has to be one of genome's
+func (s *Selection) orfOmega(genome *Genomes, orf *Orf) float64 {
+	for i := range genome.orfs {
+		if &genome.orfs[i] == orf {
+			if o, there := s.orfOmegas[orfKey(genome.orfs, i)]; there {
+				return o
+			}
+			break
+		}
+	}
+	return s.omega
+}
+
+/*
+The probability of keeping the change env would make if it became
+replacement.
+*/
+func (s *Selection) Probability(genome *Genomes, env *Environment,
+	replacement []byte) float64 {
+	protein := env.Protein()
+	altProtein := env.Translate(replacement)
+
+	windowStart := env.start - env.offset
+
+	ret := 1.0
+	for i := 0; i < len(protein); i++ {
+		a, b := protein[i], altProtein[i]
+		orf := env.orfs[i]
+		switch {
+		case a == 'X' || b == 'X':
+			return 0
+		case a == b:
+			continue
+		case a == '*' || b == '*':
+			return 0
+		case windowStart+env.codons[i*3] == orf.PosAt(0):
+			return 0
+		}
+		ret *= s.orfOmega(genome, orf) * s.weights[a][b] / s.means[orf.code]
+	}
+	return ret / s.scale
+}
+
+func (s *Selection) Show() {
+	matrix := s.matrix
+	if matrix == "" {
+		matrix = "none"
+	}
+	fmt.Printf("Keeping non-silent changes with dN/dS %.3f (amino acid "+
+		"matrix: %s)\n", s.omega, matrix)
+	keys := make([]string, 0, len(s.orfOmegas))
+	for k := range s.orfOmegas {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s: dN/dS %.3f\n", k, s.orfOmegas[k])
+	}
+}
@@ -6,6 +6,7 @@ particular kinds, in the sites of interest rather than outside them.
 package main
 
 import (
+	"bytes"
 	"fmt"
 )
 
@@ -20,7 +21,8 @@ func (sis SilentInSites) Show() {
 
 /*
 Assume there are two aligned genomes in Genomes. Return if they code for
-the same protein for count nts at pos
+the same protein for count nts at pos. If either has an X in it (because of
+ambiguity codes or gaps) we can't tell, so we say it isn't.
 */
 func isSilent(genomes *Genomes, pos int, count int) bool {
 	var aEnv, bEnv Environment
@@ -28,15 +30,11 @@ func isSilent(genomes *Genomes, pos int, count int) bool {
 	aEnv.Init(genomes, pos, count, 0)
 	bEnv.Init(genomes, pos, count, 1)
 
-	aProt := aEnv.Protein()
-	bProt := bEnv.Protein()
-
-	for k := 0; k < count; k++ {
-		if aProt[k] != bProt[k] {
-			return false
-		}
+	aProt, bProt := aEnv.Protein(), bEnv.Protein()
+	if bytes.IndexByte(aProt, 'X') != -1 || bytes.IndexByte(bProt, 'X') != -1 {
+		return false
 	}
-	return true
+	return bytes.Equal(aProt, bProt)
 }
 
 /*
@@ -97,20 +95,24 @@ func CountSilentInSites(genomes *Genomes,
 
 /*
 For each of our alignments of WH1 with various relatives, count the silent
-in sites. We will compare these to the simulated figures
+in sites. We will compare these to the simulated figures. codonAware is
+passed on to LoadWH1Alignment.
 */
 func CountSilentInSitesReference(name string, sites []ReSite,
-	results chan interface{}) {
+	codonAware bool, results chan interface{}) error {
 
 	// WH1 is the first genome in each of the alignments, so we use its
 	// ORFS
 	baseName := fmt.Sprintf("WH1-%s", name)
-	fname := fmt.Sprintf("%s.fasta", baseName)
-	genomes := LoadGenomes(fname, "WH1.orfs")
+	genomes, err := LoadWH1Alignment(name, codonAware)
+	if err != nil {
+		return err
+	}
 
 	var result TamperTrialResult
 	result.SilentInSites = CountSilentInSites(genomes, RE_SITES, false)
 	result.name = baseName
 
 	results <- &result
+	return nil
 }
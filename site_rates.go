@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Part of a genome with a weight from a bedGraph file (0-based, end excluded)
+type siteWeight struct {
+	start, end int
+	weight     float64
+}
+
+/*
+How likely each position is to be picked for a mutation. Every position in
+an ORF starts off with a rate of 1, which is multiplied by:
+
+  - A rate for each site drawn from a gamma distribution with mean 1 and
+    shape gammaShape, drawn again for each mutant. 0 means don't do this.
+  - The rate for the ORF it's in from orfRates (by orfKey), if it's there.
+  - Its weight in the track for the genome, if there's a track for it.
+    Positions the track doesn't cover get 0.
+
+Positions outside ORFs always get 0, since they can't be mutated silently.
+*/
+type SiteRates struct {
+	gammaShape float64
+	orfRates   map[string]float64
+	tracks     map[string][]siteWeight // By genome name
+}
+
+// Every position in an ORF is as likely as any other
+var UniformSiteRates = SiteRates{}
+
+func NewSiteRates(gammaShape float64, orfRates map[string]float64,
+	tracks map[string][]siteWeight) *SiteRates {
+	return &SiteRates{gammaShape, orfRates, tracks}
+}
+
+/*
+Draw from a gamma distribution with the given shape and a scale of 1, using
+Marsaglia and Tsang's method (boosted for shapes below 1).
+*/
+func randGamma(shape float64, rng *rand.Rand) float64 {
+	if shape < 1 {
+		return randGamma(shape+1, rng) * math.Pow(rng.Float64(), 1/shape)
+	}
+
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rng.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// The weight of each position in the first genome
+func (r *SiteRates) Weights(genome *Genomes, rng *rand.Rand) []float64 {
+	nts := genome.nts[0]
+	ret := make([]float64, len(nts))
+	for pos := range ret {
+		k := genome.orfs.Find(pos)
+		if k == -1 || !isUnambiguous(nts[pos]) {
+			continue
+		}
+
+		ret[pos] = 1
+		if rate, there := r.orfRates[orfKey(genome.orfs, k)]; there {
+			ret[pos] = rate
+		}
+		if r.gammaShape > 0 {
+			ret[pos] *= randGamma(r.gammaShape, rng) / r.gammaShape
+		}
+	}
+
+	track, there := r.tracks[genome.names[0]]
+	if there {
+		weights := make([]float64, len(nts))
+		for _, w := range track {
+			for pos := w.start; pos < w.end && pos < len(nts); pos++ {
+				weights[pos] = w.weight
+			}
+		}
+		for pos := range ret {
+			ret[pos] *= weights[pos]
+		}
+	}
+	return ret
+}
+
+/*
+Make a table to pick positions in the first genome from, or return nil if
+there aren't any positions with a weight. If model is a PositionWeighter it
+gets to change the weights too. Also returns how many positions have a
+weight.
+*/
+func (r *SiteRates) positionTable(genome *Genomes, model NucleotideModel,
+	rng *rand.Rand) (*aliasTable, int) {
+	weights := r.Weights(genome, rng)
+	if pw, ok := model.(PositionWeighter); ok {
+		pw.WeightPositions(genome, weights)
+	}
+	total, numSites := 0.0, 0
+	for _, w := range weights {
+		total += w
+		if w > 0 {
+			numSites++
+		}
+	}
+	if total == 0 {
+		return nil, 0
+	}
+	return newAliasTable(nil, weights), numSites
+}
+
+/*
+What the ORFs can be called in a file for LoadOrfRates, and the orfKey each
+name stands for. WH1's ORFs (from wh1, which can be any of the alignments
+LoadWH1Alignment gives you) can be called by their gene names or ORF1, ORF2
+etc. in the order of WH1.orfs, since that's what MatchOrfs names the other
+genomes' ORFs after. ORFs in genomes that WH1 doesn't have can be called
+what MatchOrfs called them, e.g. BtSY2:ORF4.
+*/
+func orfNames(wh1 *Genomes, genomes []*Genomes) map[string]string {
+	ret := make(map[string]string)
+	for _, g := range genomes {
+		for i := range g.orfs {
+			key := orfKey(g.orfs, i)
+			ret[key] = key
+		}
+	}
+	for i, orf := range wh1.orfs {
+		key := orfKey(wh1.orfs, i)
+		ret[key] = key
+		ret[fmt.Sprintf("ORF%d", i+1)] = key
+		if orf.gene != "" {
+			ret[orf.gene] = key
+		}
+	}
+	return ret
+}
+
+/*
+Load a number for each ORF (like a rate, or a dN/dS for Selection) from a
+file where each line is an ORF's name and its number. The names have to be
+in names (see orfNames), and what we return is keyed by the orfKeys they
+stand for.
+*/
+func LoadOrfRates(fname string,
+	names map[string]string) (map[string]float64, error) {
+	fd, err := openInput(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	ret := make(map[string]float64)
+	err = forEachLine(bufio.NewReader(fd), fname,
+		func(line string, lineNum int) error {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				return nil
+			}
+			if len(fields) != 2 {
+				return loadError(fname, lineNum,
+					"Expected an ORF and a number but got %d fields",
+					len(fields))
+			}
+
+			v, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil || v < 0 {
+				return loadError(fname, lineNum,
+					"\"%s\" isn't a non-negative number", fields[1])
+			}
+			key, there := names[fields[0]]
+			if !there {
+				return loadError(fname, lineNum, "No ORF called \"%s\"",
+					fields[0])
+			}
+			ret[key] = v
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+/*
+Load weights for positions from a bedGraph file: each line is the name of a
+genome (as in its FASTA file), the 0-based start and end of a region, and
+the weight for the positions in it.
+*/
+func LoadSiteWeights(fname string) (map[string][]siteWeight, error) {
+	fd, err := openInput(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	ret := make(map[string][]siteWeight)
+	err = forEachLine(bufio.NewReader(fd), fname,
+		func(line string, lineNum int) error {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") ||
+				fields[0] == "track" || fields[0] == "browser" {
+				return nil
+			}
+			if len(fields) != 4 {
+				return loadError(fname, lineNum,
+					"Expected 4 bedGraph fields but got %d", len(fields))
+			}
+
+			start, err := strconv.Atoi(fields[1])
+			if err != nil || start < 0 {
+				return loadError(fname, lineNum, "Bad start \"%s\"",
+					fields[1])
+			}
+			end, err := strconv.Atoi(fields[2])
+			if err != nil || end < start {
+				return loadError(fname, lineNum, "Bad end \"%s\"",
+					fields[2])
+			}
+			weight, err := strconv.ParseFloat(fields[3], 64)
+			if err != nil || weight < 0 {
+				return loadError(fname, lineNum,
+					"Weight \"%s\" isn't a non-negative number", fields[3])
+			}
+
+			ret[fields[0]] = append(ret[fields[0]],
+				siteWeight{start, end, weight})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
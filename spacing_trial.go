@@ -3,27 +3,30 @@ package main
 import (
 	"fmt"
 	"io"
+	"math/rand"
 	"strings"
 )
 
 type SpacingTrial struct {
-	runFunc func(genome *Genomes, numMuts int, results chan interface{})
+	runFunc func(genome *Genomes, numMuts int, firstTrial int,
+		rng *rand.Rand, results chan interface{})
 }
 
-func (t *SpacingTrial) Run(genome *Genomes, numMuts int,
-	results chan interface{}) {
-	t.runFunc(genome, numMuts, results)
+func (t *SpacingTrial) Run(genome *Genomes, numMuts int, firstTrial int,
+	rng *rand.Rand, results chan interface{}) {
+	t.runFunc(genome, numMuts, firstTrial, rng, results)
 }
 
 func (t *SpacingTrial) WriteHeadings(w io.Writer) {
 	fmt.Fprintln(w, "# Results from a Spacing Trial")
-	fmt.Fprintln(w, "name count max_length unique acceptable"+
+	fmt.Fprintln(w, "name seed count max_length unique acceptable"+
 		" interleaved muts_in_sites total_sites total_singles"+
 		" num_muts added removed genome_len positions")
 }
 
 type SpacingTrialResult struct {
 	name         string // genome name
+	seed         int64  // seed the mutant was made with (see SpacingMutant)
 	count        int    // number of sites
 	maxLength    int    // length of longest segment
 	unique       bool   // unique sticky ends?
@@ -37,6 +40,9 @@ type SpacingTrialResult struct {
 	removed      int    // How many sites were removed?
 	genomeLen    int    // length of the whole genome
 	positions    []int  // the actual positions of the sites
+	mutant       []byte // the mutant itself if it was acceptable and wanted
+	mutantMuts   int    // how many muts it actually got
+	trial        int    // which trial it was, for naming the mutant
 }
 
 func (r *SpacingTrialResult) Write(w io.Writer) {
@@ -47,7 +53,7 @@ func (r *SpacingTrialResult) Write(w io.Writer) {
 	}
 	positions := "[" + strings.Join(strPositions, ",") + "]"
 
-	fmt.Fprintln(w, r.name, r.count,
+	fmt.Fprintln(w, r.name, r.seed, r.count,
 		r.maxLength, r.unique, r.acceptable, r.interleaved,
 		r.mutsInSites, r.totalSites, r.totalSingles,
 		r.numMuts, r.added, r.removed, r.genomeLen, positions)
@@ -80,9 +86,47 @@ func addedRemoved(before map[int]bool, after []int) (int, int) {
 	return added, removed
 }
 
-func SpacingTrials(genome *Genomes, nd *NucDistro,
-	numTrials int, numMuts int, countSites bool,
-	results chan interface{}) {
+/*
+Move the original sites' positions to where they are in mutant after its
+indels, so that sites that have only moved along don't count as added and
+removed. Also returns how many of them were deleted.
+*/
+func moveSites(before map[int]bool, mutant *Genomes) (map[int]bool, int) {
+	ret := make(map[int]bool)
+	deleted := 0
+	for pos := range before {
+		if moved, ok := mutant.MovePosition(pos); ok {
+			ret[moved] = true
+		} else {
+			deleted++
+		}
+	}
+	return ret, deleted
+}
+
+/*
+The mutant of genome that a spacing trial with the given seed makes, so
+that any of them can be made again from its results. Also returns how many
+mutations it actually got, which can be fewer than numMuts if MutateSilent
+ran out of places to put them.
+*/
+func SpacingMutant(genome *Genomes, params *MutationParams, numMuts int,
+	seed int64) (*Genomes, int) {
+	mutant := genome.Clone()
+	applied := MutateSilent(mutant, params, numMuts,
+		rand.New(rand.NewSource(seed)))
+	return mutant, applied
+}
+
+/*
+Run numTrials spacing trials on genome, numbered from firstTrial, making
+mutants as params says (see MutateSilent) with seeds from rng. If
+saveMutants is true then the acceptable mutants are sent back with their
+results so they can be saved.
+*/
+func SpacingTrials(genome *Genomes, params *MutationParams, firstTrial int,
+	numTrials int, numMuts int, countSites bool, saveMutants bool,
+	rng *rand.Rand, results chan interface{}) {
 	good := 0
 
 	count, maxLength, unique, interleaved, positions :=
@@ -98,8 +142,8 @@ func SpacingTrials(genome *Genomes, nd *NucDistro,
 	}
 
 	for i := 0; i < numTrials; i++ {
-		mutant := genome.Clone()
-		MutateSilent(mutant, nd, numMuts)
+		seed := rng.Int63()
+		mutant, applied := SpacingMutant(genome, params, numMuts, seed)
 		count, maxLength, unique, interleaved, positions =
 			FindRestrictionMap(mutant)
 
@@ -118,13 +162,23 @@ func SpacingTrials(genome *Genomes, nd *NucDistro,
 			sis = CountSilentInSites(mutant, RE_SITES, true)
 		}
 
-		added, removed := addedRemoved(originalPositions, positions)
+		before, deleted := originalPositions, 0
+		if len(mutant.shifts) > 0 {
+			before, deleted = moveSites(originalPositions, mutant)
+		}
+		added, removed := addedRemoved(before, positions)
+		removed += deleted
+
+		var nts []byte
+		if saveMutants && acceptable {
+			nts = mutant.nts[0]
+		}
 
-		results <- &SpacingTrialResult{genome.names[0],
+		results <- &SpacingTrialResult{genome.names[0], seed,
 			count, maxLength, unique, acceptable, interleaved,
 			sis.totalMuts, sis.totalSites,
 			sis.totalSites, numMuts, added, removed,
-			genome.Length(), positions}
+			mutant.Length(), positions, nts, applied, firstTrial + i}
 
 		if i%100 == 0 {
 			reportProgress(i)
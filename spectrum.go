@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Where a mutation happened: which of WH1's ORFs (see orfKey), which position
+in the codon (0-2), and the nt with its neighbours either side (so the
+middle one is the one that changed).
+*/
+type spectrumKey struct {
+	orf      string
+	codonPos int
+	context  string
+}
+
+/*
+How many sites there were with a given key, and how many of them changed
+into each of NTS. The count for the nt that's already there is always 0.
+*/
+type spectrumCounts struct {
+	sites int
+	to    [4]int
+}
+
+/*
+An empirical mutation spectrum: the silent differences between WH1 and its
+relatives, split up by ORF, codon position and trinucleotide context. We
+can't really know which way a change went, but since the trials mutate the
+relatives we count from the relative's nt to WH1's, which is the direction
+we want to imitate.
+*/
+type Spectrum struct {
+	counts map[spectrumKey]*spectrumCounts
+}
+
+func NewSpectrum() *Spectrum {
+	return &Spectrum{make(map[spectrumKey]*spectrumCounts)}
+}
+
+func (s *Spectrum) get(key spectrumKey) *spectrumCounts {
+	ret, there := s.counts[key]
+	if !there {
+		ret = &spectrumCounts{}
+		s.counts[key] = ret
+	}
+	return ret
+}
+
+/*
+The key for column col of row which in an alignment, and false if it isn't
+in an ORF or its context has gaps or ambiguity codes in it.
+*/
+func spectrumKeyAt(g *Genomes, which, col int) (spectrumKey, bool) {
+	nts := g.nts[which]
+	if col < 1 || col+1 >= len(nts) {
+		return spectrumKey{}, false
+	}
+
+	k := g.orfs.Find(col)
+	if k == -1 {
+		return spectrumKey{}, false
+	}
+	_, codonPos, err := g.orfs.GetCodonOffset(col)
+	if err != nil {
+		return spectrumKey{}, false
+	}
+
+	context := nts[col-1 : col+2]
+	for _, nt := range context {
+		if ntIndex(nt) == -1 {
+			return spectrumKey{}, false
+		}
+	}
+	return spectrumKey{orfKey(g.orfs, k), codonPos, string(context)}, true
+}
+
+/*
+Fit a spectrum to alignments of WH1 (the first row) with a relative (the
+second). Only silent differences are counted, in the same way as
+CountMutations.
+*/
+func FitSpectrum(alignments []*Genomes) *Spectrum {
+	ret := NewSpectrum()
+	var env Environment
+
+	for _, g := range alignments {
+		for j := 0; j < g.Length(); j++ {
+			key, ok := spectrumKeyAt(g, 1, j)
+			if !ok {
+				continue
+			}
+			counts := ret.get(key)
+			counts.sites++
+
+			from, to := g.nts[1][j], g.nts[0][j]
+			if from == to || ntIndex(to) == -1 {
+				continue
+			}
+
+			if err := env.Init(g, j, 1, 0); err != nil {
+				continue
+			}
+			silent, _ := env.Replace(g.nts[1][j : j+1])
+			if silent {
+				counts.to[ntIndex(to)]++
+			}
+		}
+	}
+	return ret
+}
+
+type spectrumKeys []spectrumKey
+
+func (k spectrumKeys) Len() int {
+	return len(k)
+}
+
+func (k spectrumKeys) Less(i, j int) bool {
+	switch {
+	case k[i].orf != k[j].orf:
+		return k[i].orf < k[j].orf
+	case k[i].codonPos != k[j].codonPos:
+		return k[i].codonPos < k[j].codonPos
+	}
+	return k[i].context < k[j].context
+}
+
+func (k spectrumKeys) Swap(i, j int) {
+	k[i], k[j] = k[j], k[i]
+}
+
+func (s *Spectrum) sortedKeys() spectrumKeys {
+	ret := make(spectrumKeys, 0, len(s.counts))
+	for k := range s.counts {
+		ret = append(ret, k)
+	}
+	sort.Sort(ret)
+	return ret
+}
+
+/*
+Save the spectrum as a tab-separated text file. Each line is the ORF, the
+codon position (1-3), the context, the number of sites, and how many of
+them changed to A, C, G and T.
+*/
+func (s *Spectrum) Save(fname string) error {
+	fd, err := createOutput(fname)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(fd)
+	fmt.Fprintf(w, "# orf\tcodon_pos\tcontext\tsites\tA\tC\tG\tT\n")
+	for _, k := range s.sortedKeys() {
+		c := s.counts[k]
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%d\t%d\t%d\n", k.orf,
+			k.codonPos+1, k.context, c.sites, c.to[0], c.to[1], c.to[2],
+			c.to[3])
+	}
+
+	if err := w.Flush(); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// Load a spectrum that Save wrote
+func LoadSpectrum(fname string) (*Spectrum, error) {
+	fd, err := openInput(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	ret := NewSpectrum()
+	err = forEachLine(bufio.NewReader(fd), fname,
+		func(line string, lineNum int) error {
+			if line == "" || strings.HasPrefix(line, "#") {
+				return nil
+			}
+
+			fields := strings.Split(line, "\t")
+			if len(fields) != 8 {
+				return loadError(fname, lineNum,
+					"Expected 8 tab-separated columns but got %d",
+					len(fields))
+			}
+
+			context := fields[2]
+			if len(context) != 3 || strings.Trim(context, NTS) != "" {
+				return loadError(fname, lineNum, "Bad context \"%s\"",
+					context)
+			}
+
+			codonPos, err := strconv.Atoi(fields[1])
+			if err != nil || codonPos < 1 || codonPos > 3 {
+				return loadError(fname, lineNum,
+					"Codon position \"%s\" should be 1-3", fields[1])
+			}
+
+			// The number of sites and then the counts for each nt
+			var nums [5]int
+			for i := range nums {
+				nums[i], err = strconv.Atoi(fields[i+3])
+				if err != nil || nums[i] < 0 {
+					return loadError(fname, lineNum,
+						"\"%s\" isn't a count", fields[i+3])
+				}
+			}
+
+			c := ret.get(spectrumKey{fields[0], codonPos - 1, context})
+			c.sites += nums[0]
+			for i := 0; i < 4; i++ {
+				c.to[i] += nums[i+1]
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Print the 12 kinds of substitution overall and for each codon position
+func (s *Spectrum) Show() {
+	var total [4][4][4]int // By codon position (3 is all of them), from, to
+	for k, c := range s.counts {
+		from := ntIndex(k.context[1])
+		for to := 0; to < 4; to++ {
+			total[k.codonPos][from][to] += c.to[to]
+			total[3][from][to] += c.to[to]
+		}
+	}
+
+	for pos := 0; pos < 4; pos++ {
+		if pos == 3 {
+			fmt.Println("All codon positions:")
+		} else {
+			fmt.Printf("Codon position %d:\n", pos+1)
+		}
+
+		sum := 0
+		for from := 0; from < 4; from++ {
+			for to := 0; to < 4; to++ {
+				sum += total[pos][from][to]
+			}
+		}
+		for from := 0; from < 4; from++ {
+			for to := 0; to < 4; to++ {
+				if to == from {
+					continue
+				}
+				n := total[pos][from][to]
+				percent := 0.0
+				if sum > 0 {
+					percent = 100.0 * float64(n) / float64(sum)
+				}
+				fmt.Printf("%c>%c: %d %.2f%%\n", NTS[from], NTS[to], n,
+					percent)
+			}
+		}
+		fmt.Printf("Total: %d\n", sum)
+	}
+}
+
+/*
+Proposes replacements with the probabilities in a Spectrum for the ORF and
+codon position, given the nt that's there. Where the spectrum has nothing
+for that we fall back on the whole spectrum for that nt.
+
+The spectrum's ORFs are WH1's, since that's whose ORFs the alignments have,
+so genomes other than WH1 have to have been through MatchOrfs to find the
+right ones. Otherwise their ORFs would be looked up by their order, which
+is a different gene after BtSY2's extra ORF for example. An ORF that isn't
+one of WH1's doesn't match anything and gets the fallback.
+*/
+type SpectrumModel struct {
+	spectrum *Spectrum
+	tables   map[spectrumKey]*aliasTable // context is just the nt
+	other    [4]*aliasTable
+	uniform  *aliasTable // For ambiguity codes
+}
+
+// The table for what nt from becomes, or nil if there were no changes
+func spectrumTable(from int, counts [4]int) *aliasTable {
+	weights := make([]float64, 0, 3)
+	values := make([]byte, 0, 3)
+	total := 0
+	for to := 0; to < 4; to++ {
+		if to != from {
+			weights = append(weights, float64(counts[to]))
+			values = append(values, NTS[to])
+			total += counts[to]
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	return newAliasTable(values, weights)
+}
+
+func NewSpectrumModel(s *Spectrum) *SpectrumModel {
+	ret := SpectrumModel{spectrum: s,
+		tables:  make(map[spectrumKey]*aliasTable),
+		uniform: newAliasTable([]byte(NTS), make([]float64, len(NTS)))}
+
+	counts := make(map[spectrumKey][4]int)
+	var other [4][4]int
+	for k, c := range s.counts {
+		from := ntIndex(k.context[1])
+		key := spectrumKey{k.orf, k.codonPos, k.context[1:2]}
+		sum := counts[key]
+		for to := 0; to < 4; to++ {
+			sum[to] += c.to[to]
+			other[from][to] += c.to[to]
+		}
+		counts[key] = sum
+	}
+
+	for k, c := range counts {
+		if t := spectrumTable(ntIndex(k.context[0]), c); t != nil {
+			ret.tables[k] = t
+		}
+	}
+	for from := 0; from < 4; from++ {
+		ret.other[from] = spectrumTable(from, other[from])
+		if ret.other[from] == nil {
+			// Nothing at all, so anything it could become
+			ret.other[from] = spectrumTable(from, [4]int{1, 1, 1, 1})
+		}
+	}
+	return &ret
+}
+
+func (m *SpectrumModel) Draw(genome *Genomes, pos int, rng *rand.Rand) byte {
+	nt := genome.nts[0][pos]
+	from := ntIndex(nt)
+	if from == -1 {
+		return m.uniform.draw(rng)
+	}
+
+	// orfKey gives WH1's name for the ORF if the genome's been matched
+	if k := genome.orfs.Find(pos); k != -1 {
+		_, codonPos, err := genome.orfs.GetCodonOffset(pos)
+		if err == nil {
+			key := spectrumKey{orfKey(genome.orfs, k), codonPos, string(nt)}
+			if t, there := m.tables[key]; there {
+				return t.draw(rng)
+			}
+		}
+	}
+	return m.other[from].draw(rng)
+}
+
+func (m *SpectrumModel) Show() {
+	m.spectrum.Show()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+/*
+A nucleotide substitution model: the relative rate at which each nt changes
+into each other one. Rates are in the order of NTS, and rates[i][j] is from
+NTS[i] to NTS[j] (the diagonal isn't used). As a NucleotideModel it proposes
+a replacement for whatever is already at the position, so e.g. with K80 an A
+is more likely to become a G than a C or T.
+*/
+type SubstitutionModel struct {
+	name   string
+	rates  [4][4]float64
+	tables [4]*aliasTable // What each nt becomes
+	freqs  *aliasTable    // For replacing ambiguity codes
+}
+
+// The pairs of NTS indices in the order GTR's exchangeabilities are given
+var ntPairs = [6][2]int{{0, 1}, {0, 2}, {0, 3}, {1, 2}, {1, 3}, {2, 3}}
+
+// A<->G and C<->T
+func isTransition(i, j int) bool {
+	return (i == 0 && j == 2) || (i == 2 && j == 0) ||
+		(i == 1 && j == 3) || (i == 3 && j == 1)
+}
+
+/*
+The general time-reversible model, which all the others are special cases
+of. exchangeabilities are for AC, AG, AT, CG, CT and GT, and freqs are the
+equilibrium frequencies of ACGT.
+*/
+func NewGTR(name string, exchangeabilities [6]float64,
+	freqs [4]float64) *SubstitutionModel {
+	ret := SubstitutionModel{name: name}
+	for k, pair := range ntPairs {
+		i, j := pair[0], pair[1]
+		ret.rates[i][j] = exchangeabilities[k] * freqs[j]
+		ret.rates[j][i] = exchangeabilities[k] * freqs[i]
+	}
+
+	for i := 0; i < 4; i++ {
+		weights := make([]float64, 0, 3)
+		values := make([]byte, 0, 3)
+		for j := 0; j < 4; j++ {
+			if j != i {
+				weights = append(weights, ret.rates[i][j])
+				values = append(values, NTS[j])
+			}
+		}
+		ret.tables[i] = newAliasTable(values, weights)
+	}
+	ret.freqs = newAliasTable([]byte(NTS), freqs[:])
+	return &ret
+}
+
+var uniformFreqs = [4]float64{0.25, 0.25, 0.25, 0.25}
+
+// Every change is equally likely
+func NewJC69() *SubstitutionModel {
+	return NewGTR("JC69", [6]float64{1, 1, 1, 1, 1, 1}, uniformFreqs)
+}
+
+// Transitions are kappa times as likely as transversions
+func NewK80(kappa float64) *SubstitutionModel {
+	return NewHKY85(kappa, uniformFreqs)
+}
+
+// Like K80 but with unequal base frequencies
+func NewHKY85(kappa float64, freqs [4]float64) *SubstitutionModel {
+	var exchangeabilities [6]float64
+	for k, pair := range ntPairs {
+		exchangeabilities[k] = 1
+		if isTransition(pair[0], pair[1]) {
+			exchangeabilities[k] = kappa
+		}
+	}
+
+	name := "HKY85"
+	if freqs == uniformFreqs {
+		name = "K80"
+	}
+	return NewGTR(name, exchangeabilities, freqs)
+}
+
+/*
+What we count from alignments to fit the models: how many of each nt there
+are and how many times each pair of nts differ between the two genomes. We
+can't tell which way a change went from two genomes, so the pairs are
+unordered.
+*/
+type substitutionCounts struct {
+	nts   [4]float64
+	pairs [4][4]float64
+}
+
+func ntIndex(nt byte) int {
+	return strings.IndexByte(NTS, nt)
+}
+
+/*
+Count the differences between the first two genomes in each alignment,
+ignoring gaps and ambiguity codes.
+*/
+func countSubstitutions(alignments []*Genomes) *substitutionCounts {
+	var ret substitutionCounts
+	for _, g := range alignments {
+		for j := 0; j < g.Length(); j++ {
+			a, b := ntIndex(g.nts[0][j]), ntIndex(g.nts[1][j])
+			if a != -1 {
+				ret.nts[a]++
+			}
+			if b != -1 {
+				ret.nts[b]++
+			}
+			if a != -1 && b != -1 && a != b {
+				ret.pairs[a][b]++
+				ret.pairs[b][a]++
+			}
+		}
+	}
+	return &ret
+}
+
+func (c *substitutionCounts) freqs() [4]float64 {
+	var ret [4]float64
+	total := c.nts[0] + c.nts[1] + c.nts[2] + c.nts[3]
+	for i := 0; i < 4; i++ {
+		ret[i] = c.nts[i] / total
+	}
+	return ret
+}
+
+/*
+Estimate kappa as the rate of transitions over the rate of transversions,
+allowing for how many opportunities there are for each given freqs.
+*/
+func (c *substitutionCounts) kappa(freqs [4]float64) float64 {
+	var ts, tv, tsPairs, tvPairs float64
+	for _, pair := range ntPairs {
+		i, j := pair[0], pair[1]
+		if isTransition(i, j) {
+			ts += c.pairs[i][j]
+			tsPairs += freqs[i] * freqs[j]
+		} else {
+			tv += c.pairs[i][j]
+			tvPairs += freqs[i] * freqs[j]
+		}
+	}
+	if tv == 0 || tsPairs == 0 {
+		return 1
+	}
+	return (ts / tsPairs) / (tv / tvPairs)
+}
+
+/*
+Fit a GTR model to the differences between WH1 and its relatives. Each
+exchangeability is how often that pair differs divided by how common the
+two nts are, scaled so that the one for GT is 1.
+*/
+func FitGTR(alignments []*Genomes) *SubstitutionModel {
+	c := countSubstitutions(alignments)
+	freqs := c.freqs()
+
+	var exchangeabilities [6]float64
+	for k, pair := range ntPairs {
+		i, j := pair[0], pair[1]
+		exchangeabilities[k] = c.pairs[i][j] / (freqs[i] * freqs[j])
+	}
+	if gt := exchangeabilities[5]; gt > 0 {
+		for k := range exchangeabilities {
+			exchangeabilities[k] /= gt
+		}
+	}
+	return NewGTR("GTR", exchangeabilities, freqs)
+}
+
+// Fit kappa to the alignments
+func FitK80(alignments []*Genomes) *SubstitutionModel {
+	return NewK80(countSubstitutions(alignments).kappa(uniformFreqs))
+}
+
+// Fit kappa and the frequencies to the alignments
+func FitHKY85(alignments []*Genomes) *SubstitutionModel {
+	c := countSubstitutions(alignments)
+	freqs := c.freqs()
+	return NewHKY85(c.kappa(freqs), freqs)
+}
+
+// Propose a replacement for whatever nt is at pos
+func (m *SubstitutionModel) Draw(genome *Genomes, pos int,
+	rng *rand.Rand) byte {
+	i := ntIndex(genome.nts[0][pos])
+	if i == -1 {
+		return m.freqs.draw(rng)
+	}
+	return m.tables[i].draw(rng)
+}
+
+// Show the probabilities of what each nt becomes
+func (m *SubstitutionModel) Show() {
+	fmt.Printf("%s substitution model (row becomes column):\n", m.name)
+	fmt.Printf("   %6c %6c %6c %6c\n", NTS[0], NTS[1], NTS[2], NTS[3])
+	for i := 0; i < 4; i++ {
+		total := 0.0
+		for j := 0; j < 4; j++ {
+			if j != i {
+				total += m.rates[i][j]
+			}
+		}
+
+		fmt.Printf("%c: ", NTS[i])
+		for j := 0; j < 4; j++ {
+			if j == i {
+				fmt.Printf(" %6s", "-")
+			} else {
+				fmt.Printf(" %6.3f", m.rates[i][j]/total)
+			}
+		}
+		fmt.Println()
+	}
+}
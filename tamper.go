@@ -11,8 +11,8 @@ maximum of maxMuts mutations. Return where it was added or an error in the
 unlikely event that it couldn't be.
 */
 func AddSite(genome *Genomes, sites []ReSite,
-	notAt map[int]bool, maxMuts int) (int, error) {
-	site := sites[rand.Intn(len(sites))]
+	notAt map[int]bool, maxMuts int, rng *rand.Rand) (int, error) {
+	site := sites[rng.Intn(len(sites))]
 	m := len(site.pattern)
 
 	var tryAdd = func(pos int) bool {
@@ -34,7 +34,7 @@ func AddSite(genome *Genomes, sites []ReSite,
 		return silent && numMuts <= maxMuts
 	}
 
-	start := rand.Intn(genome.Length())
+	start := rng.Intn(genome.Length())
 	for i := start; i < genome.Length(); i++ {
 		if tryAdd(i) {
 			return i, nil
@@ -54,13 +54,13 @@ Remove a site from somewhere random, but not in notAt. Return the position
 it was removed from.
 */
 func RemoveSite(genome *Genomes,
-	search *CachedSearch, notAt map[int]bool) (int, error) {
+	search *CachedSearch, notAt map[int]bool, rng *rand.Rand) (int, error) {
 	n := genome.Length()
 	sites := search.GetSites()
 	m := len(sites[0].pattern)
 	nts := genome.nts[0]
 
-	genomeStart := rand.Intn(n)
+	genomeStart := rng.Intn(n)
 
 	var tryRemove = func(pos int) bool {
 		_, there := notAt[pos]
@@ -79,7 +79,7 @@ func RemoveSite(genome *Genomes,
 			return false
 		}
 
-		alt := alternatives[rand.Intn(len(alternatives))]
+		alt := alternatives[rng.Intn(len(alternatives))]
 
 		/*
 			fmt.Printf("Replacing %s <- %s at %d\n",
@@ -125,7 +125,8 @@ func RemoveSite(genome *Genomes,
 Try to silently remove the specified numbers of sites. Return the actual number
 modified
 */
-func Tamper(genome *Genomes, sites []ReSite, remove, add int) int {
+func Tamper(genome *Genomes, sites []ReSite, remove, add int,
+	rng *rand.Rand) int {
 	removed := make(map[int]bool)
 	count := 0
 
@@ -133,7 +134,7 @@ func Tamper(genome *Genomes, sites []ReSite, remove, add int) int {
 	search.Init(genome, sites)
 
 	for i := 0; i < remove; i++ {
-		pos, err := RemoveSite(genome, &search, removed)
+		pos, err := RemoveSite(genome, &search, removed, rng)
 		if err == nil {
 			removed[pos] = true
 			count++
@@ -143,7 +144,7 @@ func Tamper(genome *Genomes, sites []ReSite, remove, add int) int {
 	}
 
 	for i := 0; i < add; i++ {
-		_, err := AddSite(genome, search.GetSites(), removed, 1)
+		_, err := AddSite(genome, search.GetSites(), removed, 1, rng)
 		if err == nil {
 			count++
 		} else {
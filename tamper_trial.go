@@ -7,32 +7,36 @@ import (
 )
 
 type TamperTrial struct {
-	runFunc func(genome *Genomes, numMuts int, results chan interface{})
+	runFunc func(genome *Genomes, numMuts int, firstTrial int,
+		rng *rand.Rand, results chan interface{})
 }
 
 func (t *TamperTrial) Run(genome *Genomes,
-	numMuts int, results chan interface{}) {
-	t.runFunc(genome, numMuts, results)
+	numMuts int, firstTrial int, rng *rand.Rand, results chan interface{}) {
+	t.runFunc(genome, numMuts, firstTrial, rng, results)
 }
 
 func (t *TamperTrial) WriteHeadings(w io.Writer) {
 	fmt.Fprintln(w, "# Results from a Tamper Trial")
-	fmt.Fprintln(w, "name tampered muts_in_sites total_sites total_singles")
+	fmt.Fprintln(w, "name seed tampered muts_in_sites total_sites "+
+		"total_singles")
 }
 
 type TamperTrialResult struct {
 	SilentInSites
 	name     string
+	seed     int64 // 0 for the real differences
 	tampered bool
 }
 
 func (r *TamperTrialResult) Write(w io.Writer) {
-	fmt.Fprintln(w, r.name, r.tampered,
+	fmt.Fprintln(w, r.name, r.seed, r.tampered,
 		r.totalMuts, r.totalSites, r.totalSingleSites)
 }
 
-func TamperTrials(genome *Genomes, nd *NucDistro,
-	numTrials int, numMuts int, numEdits int, results chan interface{}) {
+func TamperTrials(genome *Genomes, params *MutationParams,
+	numTrials int, numMuts int, numEdits int, rng *rand.Rand,
+	results chan interface{}) {
 
 	reportProgress := func(n int) {
 		fmt.Printf("%s (%d muts) %d/%d trials\n",
@@ -40,18 +44,20 @@ func TamperTrials(genome *Genomes, nd *NucDistro,
 	}
 
 	for i := 0; i < numTrials; i++ {
+		seed, trialRng := nextTrialRand(rng)
 		mutant := genome.Clone()
-		MutateSilent(mutant, nd, numMuts)
+		MutateSilent(mutant, params, numMuts, trialRng)
 
-		tampered := rand.Intn(2) == 1
+		tampered := trialRng.Intn(2) == 1
 		if tampered {
-			Tamper(mutant, RE_SITES, numEdits, numEdits)
+			Tamper(mutant, RE_SITES, numEdits, numEdits, trialRng)
 		}
 
 		var result TamperTrialResult
 		mutant.Combine(genome)
 		result.SilentInSites = CountSilentInSites(mutant, RE_SITES, true)
 		result.name = genome.names[0]
+		result.seed = seed
 		result.tampered = tampered
 
 		results <- &result
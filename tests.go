@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"math/rand"
 )
 
 func testMutations(genome *Genomes) {
@@ -12,11 +14,13 @@ func testMutations(genome *Genomes) {
 	fmt.Printf("Saved as B52-test.fasta\n")
 
 	nd := NewNucDistro(genome)
+	params := MutationParams{nd, &UniformSiteRates, nil, nil}
 
+	rng := rand.New(rand.NewSource(1))
 	var mutant *Genomes
 	for {
 		mutant = genome.Clone()
-		MutateSilent(mutant, nd, 700)
+		MutateSilent(mutant, &params, 700, rng)
 		count, maxLength, unique, interleaved, _ :=
 			FindRestrictionMap(mutant)
 		if unique && maxLength < 8000 {
@@ -25,11 +29,12 @@ func testMutations(genome *Genomes) {
 		}
 	}
 	mutant.Save("Mutant", "B52-mutated.fasta", 0)
-	fmt.Printf("Saved as B52-mutated.fasta\n")
+	mutant.orfs.SaveGFF3("B52-mutated.gff3", "Mutant", mutant.Length())
+	fmt.Printf("Saved as B52-mutated.fasta with B52-mutated.gff3\n")
 }
 
 func testTamper(genome *Genomes) {
-	num := Tamper(genome, RE_SITES, 10, 10)
+	num := Tamper(genome, RE_SITES, 10, 10, rand.New(rand.NewSource(1)))
 	fmt.Printf("Tampered with %d sites\n", num)
 
 	genome.Save("Mutant", "B52-mutated.fasta", 0)
@@ -76,7 +81,10 @@ func testTranslate(genome *Genomes) {
 }
 
 func Test() {
-	genome := LoadGenomes("BANAL-20-52.fasta", "BANAL-20-52.orfs")
+	genome, err := LoadGenomes("BANAL-20-52.fasta", "BANAL-20-52.orfs")
+	if err != nil {
+		log.Fatal(err)
+	}
 	// testCachedSearch(genome)
 	// testMutations(genome)
 	// testAlternatives(genome)
@@ -2,224 +2,447 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"os"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 )
 
-var CodonTable = map[string]byte{
-	"TTT": 'F', // Phenylalanine
-	"TTC": 'F',
-
-	"TTA": 'L', // Leucine
-	"TTG": 'L',
-	"CTT": 'L',
-	"CTC": 'L',
-	"CTA": 'L',
-	"CTG": 'L',
-
-	"ATT": 'I', // Isoleucine
-	"ATC": 'I',
-	"ATA": 'I',
-
-	"ATG": 'M', // Methionine
-
-	"GTT": 'V', // Valine
-	"GTC": 'V',
-	"GTA": 'V',
-	"GTG": 'V',
-
-	"TCT": 'S', // Serine
-	"TCC": 'S',
-	"TCA": 'S',
-	"TCG": 'S',
-
-	"CCT": 'P', // Proline
-	"CCC": 'P',
-	"CCA": 'P',
-	"CCG": 'P',
-
-	"ACT": 'T', // Threonine
-	"ACC": 'T',
-	"ACA": 'T',
-	"ACG": 'T',
-
-	"GCT": 'A', // Alanine
-	"GCC": 'A',
-	"GCA": 'A',
-	"GCG": 'A',
-
-	"TAT": 'Y', // Tyrosine
-	"TAC": 'Y',
-
-	"TAA": '*', // Stop
-	"TAG": '*',
-
-	"CAT": 'H', // Histidine
-	"CAC": 'H',
-
-	"CAA": 'Q', // Glutadine
-	"CAG": 'Q',
-
-	"AAT": 'N', // Asparagine
-	"AAC": 'N',
+/*
+A contiguous piece of an ORF. 0-based, end exclusive, like everything else
+once we've loaded it.
+*/
+type Segment struct {
+	start, end int
+}
 
-	"AAA": 'K', // Lysine
-	"AAG": 'K',
+/*
+An ORF is read through its segments in order, so that its codons are made
+of the concatenation of them. Most ORFs only have one segment. Where a
+segment starts before the previous one ended that's a -1 frameshift, which
+is how we represent ORF1ab: the nt at the slippery sequence is read twice,
+once as the last nt of the last codon of ORF1a and once as the first nt of
+the next codon.
+
+If the ORF is on the minus strand (reverse is set) each segment is read
+from its end back to its start, and the nts are complemented. The segments
+are still in the order they're read in, so the first one is the rightmost.
+*/
+type Orf struct {
+	start, end    int          // The extent of all the segments
+	segments      []Segment    // The pieces read in order
+	reverse       bool         // Whether it's on the minus strand
+	code          *GeneticCode // How to translate it
+	gene, product string       // Only known if we loaded them from GenBank
+	line          int          // Where it was in the file we loaded it from
+	name          string       // Its orfKey in WH1 (see MatchOrfs)
+}
 
-	"GAT": 'D', // Aspartic acid
-	"GAC": 'D',
+type Orfs []Orf
 
-	"GAA": 'E', // Glutamic acid
-	"GAG": 'E',
+func NewOrf(segments []Segment, reverse bool) Orf {
+	ret := Orf{segments: segments, reverse: reverse, code: StandardCode}
+	ret.start, ret.end = segments[0].start, segments[0].end
+	for _, seg := range segments[1:] {
+		if seg.start < ret.start {
+			ret.start = seg.start
+		}
+		if seg.end > ret.end {
+			ret.end = seg.end
+		}
+	}
+	return ret
+}
 
-	"TGT": 'C', // Cysteine
-	"TGC": 'C',
+func (orf *Orf) Contains(pos int) bool {
+	if pos < orf.start || pos >= orf.end {
+		return false
+	}
+	for _, seg := range orf.segments {
+		if pos >= seg.start && pos < seg.end {
+			return true
+		}
+	}
+	return false
+}
 
-	"TGA": '*', // Stop
-	"TGG": 'W', // Tryptophan
+// How many nts there are in the ORF once the segments are joined up
+func (orf *Orf) Length() int {
+	ret := 0
+	for _, seg := range orf.segments {
+		ret += seg.end - seg.start
+	}
+	return ret
+}
 
-	"CGT": 'R', // Arginine
-	"CGC": 'R',
-	"CGA": 'R',
-	"CGG": 'R',
+// How far into seg pos is, in the direction it's read
+func (orf *Orf) segOffset(seg Segment, pos int) int {
+	if orf.reverse {
+		return seg.end - 1 - pos
+	}
+	return pos - seg.start
+}
 
-	"AGT": 'S', // Serine
-	"AGC": 'S',
+// Map an offset into the joined-up ORF back to a position in the genome
+func (orf *Orf) PosAt(offset int) int {
+	for _, seg := range orf.segments {
+		n := seg.end - seg.start
+		if offset < n {
+			if orf.reverse {
+				return seg.end - 1 - offset
+			}
+			return seg.start + offset
+		}
+		offset -= n
+	}
+	return -1
+}
 
-	"AGA": 'R', // Arginine (again)
-	"AGG": 'R',
+/*
+Returns the positions of the frameshifts and how big they are (-1 means a
+nt gets read twice). The position is the first nt read in the next segment.
+*/
+func (orf *Orf) Frameshifts() ([]int, []int) {
+	positions, shifts := make([]int, 0), make([]int, 0)
+	for i := 1; i < len(orf.segments); i++ {
+		prev, seg := orf.segments[i-1], orf.segments[i]
+		if orf.reverse {
+			if seg.end != prev.start {
+				positions = append(positions, seg.end-1)
+				shifts = append(shifts, prev.start-seg.end)
+			}
+		} else if seg.start != prev.end {
+			positions = append(positions, seg.start)
+			shifts = append(shifts, seg.start-prev.end)
+		}
+	}
+	return positions, shifts
+}
 
-	"GGT": 'G', // Glycine
-	"GGC": 'G',
-	"GGA": 'G',
-	"GGG": 'G',
+// Use code to translate all the ORFs
+func (orfs Orfs) SetGeneticCode(code *GeneticCode) {
+	for i := range orfs {
+		orfs[i].code = code
+	}
 }
 
-var ReverseCodonTable map[byte][]string
+func (orfs Orfs) Len() int {
+	return len(orfs)
+}
 
-type Orf struct {
-	start, end int
+func (orfs Orfs) Less(i, j int) bool {
+	return orfs[i].start < orfs[j].start
 }
 
-type Orfs []Orf
+func (orfs Orfs) Swap(i, j int) {
+	orfs[i], orfs[j] = orfs[j], orfs[i]
+}
 
-func LoadOrfs(fname string) Orfs {
+/*
+Each line of an .orfs file is the 1-based start and end of an ORF. If an
+ORF has more than one segment they're all on the same line, so ORF1ab with
+its frameshift is "266 13468 13468 21555". ORFs on the minus strand are
+written the way they're read, from the higher position to the lower one,
+so "500 201" is a minus-strand ORF covering 201 to 500.
+*/
+func LoadOrfs(fname string) (Orfs, error) {
 	ret := make(Orfs, 0)
 
-	fd, err := os.Open(fname)
+	fd, err := openInput(fname)
 	if err != nil {
-		log.Fatal("Can't open file")
+		return nil, err
 	}
 	defer fd.Close()
 
 	fp := bufio.NewReader(fd)
 
+	lineNum := 0
 loop:
 	for {
 		line, err := fp.ReadString('\n')
 		switch err {
 		case io.EOF:
-			break loop
+			if line == "" {
+				break loop
+			}
 		case nil:
 			break
 		default:
-			log.Fatal("Can't read file")
+			return nil, &LoadError{fname, lineNum, err}
 		}
+		lineNum++
 
 		line = strings.TrimSpace(line)
 		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields)%2 != 0 {
+			return nil, loadError(fname, lineNum,
+				"Expected pairs of coordinates but got %d numbers",
+				len(fields))
+		}
+
+		segments := make([]Segment, 0, len(fields)/2)
+		var reverse bool
+		for i := 0; i < len(fields); i += 2 {
+			start, err := strconv.Atoi(fields[i])
+			if err != nil {
+				return nil, loadError(fname, lineNum,
+					"ORF coordinate \"%s\" isn't a number", fields[i])
+			}
+
+			end, err := strconv.Atoi(fields[i+1])
+			if err != nil {
+				return nil, loadError(fname, lineNum,
+					"ORF coordinate \"%s\" isn't a number", fields[i+1])
+			}
+
+			if start < 1 || end < 1 {
+				return nil, loadError(fname, lineNum,
+					"ORF coordinates start at 1")
+			}
+
+			if i == 0 {
+				reverse = start > end
+			} else if reverse != (start > end) {
+				return nil, loadError(fname, lineNum,
+					"ORF has segments on both strands")
+			}
+
+			if reverse {
+				start, end = end, start
+			}
 
-		start, err := strconv.Atoi(fields[0])
-		if err != nil {
-			log.Fatal("Parse error in ORFs")
+			// ORFs seem to be conventionally 1-based
+			start -= 1
+
+			segments = append(segments, Segment{start, end})
 		}
 
-		// ORFs seem to be conventionally 1-based
-		start -= 1
+		orf := NewOrf(segments, reverse)
+		orf.line = lineNum
 
-		end, err := strconv.Atoi(fields[1])
-		if err != nil {
-			log.Fatal("Parse error in ORFs")
+		if orf.Length()%3 != 0 {
+			return nil, loadError(fname, lineNum,
+				"ORF length %d isn't a multiple of 3", orf.Length())
 		}
 
-		ret = append(ret, Orf{start, end})
+		ret = append(ret, orf)
 	}
 
-	return ret
+	return ret, nil
 }
 
 /*
 Return the start of the codon and where pos is in it. We just do a linear
 search since there aren't usually that many ORFs and this is probably as
-fast as anything else
+fast as anything else. Where a codon is split across segments the start is
+the position of its first nt. On the minus strand the start is the
+rightmost nt of the codon since that's the one read first, and the offset
+counts leftwards from there.
 */
 func (orfs Orfs) GetCodonOffset(pos int) (int, int, error) {
 	for i := 0; i < len(orfs); i++ {
 		orf := &orfs[i]
-		if pos >= orf.start && pos < orf.end {
-			orfPos := pos - orf.start // pos relative to start of ORF
-			return orf.start + (orfPos/3)*3, orfPos % 3, nil
+		if !orf.Contains(pos) {
+			continue
+		}
+
+		orfPos := 0 // pos relative to the start of the joined-up ORF
+		for _, seg := range orf.segments {
+			if pos >= seg.start && pos < seg.end {
+				orfPos += orf.segOffset(seg, pos)
+				return orf.PosAt((orfPos / 3) * 3), orfPos % 3, nil
+			}
+			orfPos += seg.end - seg.start
 		}
 	}
 	return 0, 0, errors.New("Not in ORF")
-
 }
 
-// The "Environment" of a subsequence is the codon-aligned section that
-// completely contains it.
+/*
+The "Environment" of a subsequence is all the codons that any of it is part
+of. Usually they're all next to each other, but if there's a frameshift
+they can overlap, and if an ORF is in pieces a codon might be too. ORFs can
+also overlap each other (like ORF9b inside N), in which case some nts are in
+codons in more than one frame. So we keep the section of the genome that
+contains everything, and where the nts of each codon are in it.
+
+The first numPrimary codons are from the first ORF containing the start of
+the subsequence and the rest are from any other ORFs it overlaps. A change
+is only silent if it's silent in all of them. The nts of codons on the minus
+strand are listed in the order they're read, and get complemented when we
+translate them. Each codon is translated with its own ORF's genetic code.
+*/
 type Environment struct {
 	start int // Index into the original genome
 	len   int // How many nts in the subsequence this represents
 
-	window  []byte // The whole aligned section
-	offset  int    // The offset to the start of the subsequence
-	protein []byte // Its translation
+	window     []byte // The section containing the codons and subsequence
+	offset     int    // The offset to the start of the subsequence
+	codons     []int  // Offsets into window of the nts of each codon, 3 each
+	orfs       []*Orf // Which ORF each codon is from
+	numPrimary int    // How many of the codons are from the primary ORF
+	protein    []byte // Its translation, one aa per codon
 }
 
-// rounded up to the nearest multiple of 3
-func ceil3(n int) int {
-	return n + 3 - n%3
+// The complement of a nt, including the ambiguity codes
+func complement(nt byte) byte {
+	switch nt {
+	case 'A':
+		return 'T'
+	case 'T':
+		return 'A'
+	case 'C':
+		return 'G'
+	case 'G':
+		return 'C'
+	case 'R':
+		return 'Y'
+	case 'Y':
+		return 'R'
+	case 'K':
+		return 'M'
+	case 'M':
+		return 'K'
+	case 'B':
+		return 'V'
+	case 'V':
+		return 'B'
+	case 'D':
+		return 'H'
+	case 'H':
+		return 'D'
+	}
+	return nt // S, W, N and -
+}
+
+func ReverseComplement(nts []byte) []byte {
+	n := len(nts)
+	ret := make([]byte, n)
+	for i := 0; i < n; i++ {
+		ret[i] = complement(nts[n-i-1])
+	}
+	return ret
 }
 
 /*
-Assume nts are codon aligned and return a translation, with one amino-acid
-letter per nt, so something like LLLRRRIII
+Translate the codons in window, with one aa per codon, using the genetic
+code of the ORF each one is from. Codons from ORFs on the minus strand need
+complementing.
 */
-func TranslateAligned(nts []byte) []byte {
-	ret := make([]byte, len(nts))
+func translateCodons(window []byte, codons []int, orfs []*Orf) []byte {
+	ret := make([]byte, len(codons)/3)
+	var codon [3]byte
 
-	for i := 0; i < len(nts); i += 3 {
-		aa := CodonTable[string(nts[i:i+3])]
+	for i := 0; i < len(ret); i++ {
 		for j := 0; j < 3; j++ {
-			ret[i+j] = aa
+			codon[j] = window[codons[i*3+j]]
+			if orfs[i].reverse {
+				codon[j] = complement(codon[j])
+			}
 		}
+		ret[i] = orfs[i].code.Translate(codon[:])
 	}
 	return ret
 }
 
+/*
+Find the genome positions of the nts of all the codons in orf that overlap
+pos to pos+n, appending them to codons.
+*/
+func (orf *Orf) findCodons(pos int, n int, codons []int) []int {
+	length := orf.Length()
+	orfPos := 0 // Where we are in the joined-up ORF
+	prevCodon := -1
+
+	for _, seg := range orf.segments {
+		start, end := pos, pos+n
+		if start < seg.start {
+			start = seg.start
+		}
+		if end > seg.end {
+			end = seg.end
+		}
+
+		for p := start; p < end; p++ {
+			codon := (orfPos + orf.segOffset(seg, p)) / 3
+			if codon == prevCodon || codon*3+3 > length {
+				continue
+			}
+			prevCodon = codon
+
+			for j := 0; j < 3; j++ {
+				codons = append(codons, orf.PosAt(codon*3+j))
+			}
+		}
+		orfPos += seg.end - seg.start
+	}
+	return codons
+}
+
 func (env *Environment) Init(genome *Genomes,
 	pos int, n int, which int) error {
 	env.start = pos
 	env.len = n
 
-	windowStart, codonOffset, err := genome.orfs.GetCodonOffset(pos)
-	if err != nil {
-		return err
+	orfs := genome.orfs
+	primary := -1
+	for i := 0; i < len(orfs); i++ {
+		if orfs[i].Contains(pos) {
+			primary = i
+			break
+		}
+	}
+	if primary == -1 {
+		return errors.New("Not in ORF")
 	}
 
-	windowLen := ceil3(codonOffset + n)
-	windowEnd := windowStart + windowLen
+	codons := orfs[primary].findCodons(pos, n, make([]int, 0, 6))
+	env.numPrimary = len(codons) / 3
+	codonOrfs := make([]*Orf, env.numPrimary)
+	for i := range codonOrfs {
+		codonOrfs[i] = &orfs[primary]
+	}
 
-	env.offset = codonOffset
+	// Now the codons in any other frames the subsequence is in
+	for i := 0; i < len(orfs); i++ {
+		if i == primary || orfs[i].end <= pos || orfs[i].start >= pos+n {
+			continue
+		}
+		codons = orfs[i].findCodons(pos, n, codons)
+		for len(codonOrfs) < len(codons)/3 {
+			codonOrfs = append(codonOrfs, &orfs[i])
+		}
+	}
+
+	// The window has to contain the whole subsequence as well as all the
+	// codons.
+	windowStart, windowEnd := pos, pos+n
+	for _, p := range codons {
+		if p < windowStart {
+			windowStart = p
+		}
+		if p >= windowEnd {
+			windowEnd = p + 1
+		}
+	}
+
+	for i := range codons {
+		codons[i] -= windowStart
+	}
+
+	env.offset = pos - windowStart
 	env.window = genome.nts[which][windowStart:windowEnd]
-	env.protein = TranslateAligned(env.window)
+	env.codons = codons
+	env.orfs = codonOrfs
+	env.protein = translateCodons(env.window, env.codons, env.orfs)
 	return nil
 }
 
@@ -227,8 +450,9 @@ func (env *Environment) Subsequence() []byte {
 	return env.window[env.offset : env.offset+env.len]
 }
 
+// The translation of all the codons the subsequence touches
 func (env *Environment) Protein() []byte {
-	return env.protein[env.offset : env.offset+env.len]
+	return env.protein
 }
 
 func (env *Environment) Print() {
@@ -238,19 +462,17 @@ func (env *Environment) Print() {
 
 /*
 If we were to replace the subsequence this is the environment of, would
-that be silent, and how many mutations would it contain?
+that be silent, and how many mutations would it contain? If any of the
+codons translate to X, before or after, we can't know if it's silent, so we
+say it isn't. That means we never edit around ambiguity codes.
 */
 func (env *Environment) Replace(replacement []byte) (bool, int) {
-	altWindow := make([]byte, len(env.window))
-	copy(altWindow, env.window)
-	copy(altWindow[env.offset:env.offset+env.len], replacement)
-
 	protein := env.protein
-	altProtein := TranslateAligned(altWindow)
+	altProtein := env.Translate(replacement)
 
 	silent := true
-	for i := 0; i < len(protein); i += 3 {
-		if altProtein[i] != protein[i] {
+	for i := 0; i < len(protein); i++ {
+		if altProtein[i] != protein[i] || protein[i] == 'X' {
 			silent = false
 			break
 		}
@@ -267,6 +489,14 @@ func (env *Environment) Replace(replacement []byte) (bool, int) {
 	return silent, differences
 }
 
+// What Protein would be if we replaced the subsequence with replacement
+func (env *Environment) Translate(replacement []byte) []byte {
+	altWindow := make([]byte, len(env.window))
+	copy(altWindow, env.window)
+	copy(altWindow[env.offset:env.offset+env.len], replacement)
+	return translateCodons(altWindow, env.codons, env.orfs)
+}
+
 // Silent alternative to a sequence of nts and how many muts that would require
 type Alternative struct {
 	numMuts int
@@ -277,12 +507,14 @@ type Alternatives []Alternative
 
 // Iterator for finding the alternatives to a given subsequence
 type altIter struct {
-	protein  []byte // the protein we're finding nts for, as RL not RRRLLL
-	odometer []int  // tracks the codon combinations as we iterate them
+	protein  []byte       // the protein we're finding nts for, as RL not RRRLLL
+	code     *GeneticCode // which codons code for which aa
+	odometer []int        // tracks the codon combinations as we iterate them
 }
 
-func (it *altIter) Init(protein []byte) {
+func (it *altIter) Init(protein []byte, code *GeneticCode) {
 	it.protein = protein
+	it.code = code
 	it.odometer = make([]int, len(protein))
 }
 
@@ -295,13 +527,13 @@ func (it *altIter) Next() ([]byte, bool) {
 	ret := make([]byte, 0, len(prot)*3)
 
 	for i := 0; i < len(prot); i++ {
-		codons := ReverseCodonTable[prot[i]]
+		codons := it.code.Codons(prot[i])
 		ret = append(ret, []byte(codons[it.odometer[i]])...)
 	}
 
 	// Increment the odometer like a sort of odometer
 	for j := 0; j < len(prot); j++ {
-		codons := ReverseCodonTable[prot[j]]
+		codons := it.code.Codons(prot[j])
 		if it.odometer[j]+1 < len(codons) {
 			it.odometer[j]++
 			for k := 0; k < j; k++ {
@@ -317,7 +549,7 @@ func (it *altIter) Next() ([]byte, bool) {
 func TestAlternatives() {
 	protein := []byte("LF")
 	var it altIter
-	it.Init(protein)
+	it.Init(protein, StandardCode)
 
 	for {
 		alt, more := it.Next()
@@ -346,27 +578,57 @@ func (a Alternatives) Swap(i, j int) {
 
 /*
 Find the alternative nt sequences that would not change the protein here,
-ordered by fewest muts first.
+ordered by fewest muts first. There aren't any if there are ambiguity codes
+in any of the codons (the protein will have an X in it).
 */
 func (env *Environment) FindAlternatives(maxMuts int) Alternatives {
 	var it altIter
 	ret := make(Alternatives, 0)
 
-	// The protein stored in env is like LLLRRRIII. We want just LRI.
-	windowLen := len(env.window)
-	protein := make([]byte, windowLen/3)
-	for i, _ := range protein {
-		protein[i] = env.protein[i*3]
-	}
+	// We iterate through the synonymous codons in the primary frame, and
+	// then check that the result is also silent in any other frames.
+	primaryCodons := env.codons[:env.numPrimary*3]
+	otherCodons := env.codons[env.numPrimary*3:]
+	otherOrfs := env.orfs[env.numPrimary:]
+	otherProtein := env.protein[env.numPrimary:]
 
-	it.Init(protein)
+	if env.numPrimary == 0 || bytes.IndexByte(env.protein, 'X') != -1 {
+		return ret
+	}
+	it.Init(env.protein[:env.numPrimary], env.orfs[0].code)
 	existing := env.Subsequence()
 
+alternatives:
 	for more := true; more; {
-		var alt []byte
-		alt, more = it.Next()
+		var codons []byte
+		codons, more = it.Next()
 		start, end := env.offset, env.offset+env.len
 
+		// All the primary codons are on the same strand
+		if env.orfs[0].reverse {
+			for i := range codons {
+				codons[i] = complement(codons[i])
+			}
+		}
+
+		// Put the codons where they go. If two codons share an nt (because of
+		// a frameshift) they have to agree on what it is.
+		alt := make([]byte, len(env.window))
+		copy(alt, env.window)
+		for i, p := range primaryCodons {
+			alt[p] = codons[i]
+		}
+		for i, p := range primaryCodons {
+			if alt[p] != codons[i] {
+				continue alternatives
+			}
+		}
+
+		if !bytes.Equal(translateCodons(alt, otherCodons, otherOrfs),
+			otherProtein) {
+			continue
+		}
+
 		// The alternative is no good if it differs outside the subsequence
 		if !reflect.DeepEqual(alt[:start], env.window[:start]) {
 			continue
@@ -387,10 +649,6 @@ func (env *Environment) FindAlternatives(maxMuts int) Alternatives {
 			ret = append(ret, Alternative{numMuts,
 				alt[start:end]})
 		}
-
-		if !more {
-			break
-		}
 	}
 
 	sort.Sort(ret)
@@ -398,48 +656,48 @@ func (env *Environment) FindAlternatives(maxMuts int) Alternatives {
 }
 
 /*
-Just translate a whole genome, iterating over all the codons in it from the
-start
+Just translate a whole genome, iterating over all the codons in each ORF in
+turn, following the segments so that we stay in the right frame across any
+frameshifts. Codons on the minus strand come out reverse complemented, and
+pos is the position of the first nt read.
 */
 type CodonIter struct {
 	genome *Genomes // Alignment of genomes
 	which  int      // Which one you want to translate
 	orfI   int      // Which ORF we're in
-	pos    int      // Where we are in it
+	pos    int      // Where we are in it (in the joined-up ORF)
 }
 
 func (it *CodonIter) Init(genome *Genomes, which int) {
 	it.genome = genome
 	it.which = which
-	it.pos = genome.orfs[0].start
+	it.orfI = 0
+	it.pos = 0
 }
 
 func (it *CodonIter) Next() (pos int,
 	codon string, aa byte, err error) {
 	genome := it.genome
+	nts := genome.nts[it.which]
+
 	for ; it.orfI < len(genome.orfs); it.orfI++ {
-		orf := genome.orfs[it.orfI]
-		pos = it.pos
-		if pos+3 <= orf.end {
-			codon = string(genome.nts[it.which][pos : pos+3])
-			aa = CodonTable[codon]
+		orf := &genome.orfs[it.orfI]
+		if it.pos+3 <= orf.Length() {
+			var c [3]byte
+			for j := 0; j < 3; j++ {
+				c[j] = nts[orf.PosAt(it.pos+j)]
+				if orf.reverse {
+					c[j] = complement(c[j])
+				}
+			}
+			pos = orf.PosAt(it.pos)
+			codon = string(c[:])
+			aa = orf.code.Translate(c[:])
 			err = nil
-			it.pos = pos + 3
+			it.pos += 3
 			return
 		}
+		it.pos = 0
 	}
 	return 0, "", 0, errors.New("No more ORFs")
 }
-
-func init() {
-	ReverseCodonTable = make(map[byte][]string)
-	for k := range CodonTable {
-		v, _ := CodonTable[k]
-
-		codons, there := ReverseCodonTable[v]
-		if !there {
-			codons = make([]string, 0)
-		}
-		ReverseCodonTable[v] = append(codons, k)
-	}
-}
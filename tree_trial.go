@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+/*
+Draw from a Poisson distribution using Knuth's method, in chunks so that
+exp(-mean) doesn't underflow when the mean is big.
+*/
+func randPoisson(mean float64, rng *rand.Rand) int {
+	ret := 0
+	for mean > 0 {
+		chunk := math.Min(mean, 30)
+		mean -= chunk
+
+		limit := math.Exp(-chunk)
+		for p := rng.Float64(); p > limit; p *= rng.Float64() {
+			ret++
+		}
+	}
+	return ret
+}
+
+/*
+Simulate evolution down tree starting with the first genome in genome at the
+root, whatever the tree's root is called. The number of mutations proposed
+on each branch is Poisson with a mean of its length times scale, so if the
+branch lengths are substitutions per site scale should be the length of the
+genome. Only the ones MutateProposals keeps happen, so the nodes only get
+silent changes in the ORFs unless params has a selection, and then only the
+non-silent ones it keeps. Returns an alignment with a row for every node in
+the order tree.Nodes() gives them (parents before their children), named
+after the node (or node<n> if it doesn't have a name, where n is its row).
+The names are just labels: the tips don't have to be genomes we know about,
+and nothing is taken from any that are. The rows all have to line up, so
+params can't have indels.
+*/
+func SimulateTree(genome *Genomes, tree *TreeNode, params *MutationParams,
+	scale float64, rng *rand.Rand) *Genomes {
+	nodes := tree.Nodes()
+	ret := NewGenomes(genome.orfs, len(nodes))
+	rows := make(map[*TreeNode]int)
+	for i, node := range nodes {
+		rows[node] = i
+	}
+
+	var simulate func(node *TreeNode, parent []byte)
+	simulate = func(node *TreeNode, parent []byte) {
+		// Named after the root genome so that it gets its -site-weights
+		g := NewGenomes(genome.orfs, 1)
+		g.names[0] = genome.names[0]
+		g.nts[0] = make([]byte, len(parent))
+		copy(g.nts[0], parent)
+		MutateProposals(g, params, randPoisson(node.length*scale, rng),
+			rng)
+
+		i := rows[node]
+		ret.nts[i], ret.names[i] = g.nts[0], node.name
+		if ret.names[i] == "" {
+			ret.names[i] = fmt.Sprintf("node%d", i)
+		}
+
+		for _, child := range node.children {
+			simulate(child, g.nts[0])
+		}
+	}
+
+	simulate(tree, genome.nts[0])
+	return ret
+}
+
+type TreeTrial struct {
+	runFunc func(genome *Genomes, numMuts int, firstTrial int,
+		rng *rand.Rand, results chan interface{})
+}
+
+func (t *TreeTrial) Run(genome *Genomes, numMuts int, firstTrial int,
+	rng *rand.Rand, results chan interface{}) {
+	t.runFunc(genome, numMuts, firstTrial, rng, results)
+}
+
+func (t *TreeTrial) WriteHeadings(w io.Writer) {
+	fmt.Fprintln(w, "# Results from a Tree Trial")
+	fmt.Fprintln(w, "name seed tips acceptable acceptable_tips")
+}
+
+type TreeTrialResult struct {
+	name           string   // genome at the root
+	seed           int64    // what the simulation was seeded with
+	tips           int      // how many tips the tree has
+	acceptable     int      // how many of them look like a synthetic genome
+	acceptableTips []string // which ones
+}
+
+func (r *TreeTrialResult) Write(w io.Writer) {
+	// Newick names can have spaces in them but ours are space separated
+	tips := strings.ReplaceAll(strings.Join(r.acceptableTips, ","), " ", "_")
+	fmt.Fprintln(w, r.name, r.seed, r.tips, r.acceptable, "["+tips+"]")
+}
+
+/*
+Run numTrials simulations down tree from genome, and see how many of the
+tips end up with a restriction map like WH1's (unique sticky ends and no
+segment 8000nts or longer).
+*/
+func TreeTrials(genome *Genomes, tree *TreeNode, params *MutationParams,
+	scale float64, numTrials int, rng *rand.Rand, results chan interface{}) {
+	nodes := tree.Nodes()
+	good := 0
+
+	reportProgress := func(n int) {
+		fmt.Printf("%s: tested %d. Found %d tips with good maps\n",
+			genome.names[0], n, good)
+	}
+
+	for i := 0; i < numTrials; i++ {
+		seed, trialRng := nextTrialRand(rng)
+		simulated := SimulateTree(genome, tree, params, scale, trialRng)
+
+		result := TreeTrialResult{name: genome.names[0], seed: seed,
+			acceptableTips: make([]string, 0)}
+		for j, node := range nodes {
+			if !node.IsTip() {
+				continue
+			}
+			result.tips++
+
+			tip := NewGenomes(simulated.orfs, 1)
+			tip.nts[0], tip.names[0] = simulated.nts[j], simulated.names[j]
+			_, maxLength, unique, _, _ := FindRestrictionMap(tip)
+			if unique && maxLength < 8000 {
+				result.acceptable++
+				result.acceptableTips = append(result.acceptableTips,
+					tip.names[0])
+			}
+		}
+		good += result.acceptable
+
+		results <- &result
+
+		if i%100 == 0 {
+			reportProgress(i)
+		}
+	}
+
+	reportProgress(numTrials)
+}
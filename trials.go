@@ -2,80 +2,337 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type TrialResult interface {
 	Write(w io.Writer)
 }
 
+/*
+Each thread calls Run for each genome to do its share of the trials, which
+are numbered from firstTrial so that their results can say which they were
+however the threads' results end up interleaved.
+*/
 type Trial interface {
 	WriteHeadings(w io.Writer)
-	Run(genome *Genomes, numMuts int, results chan interface{})
+	Run(genome *Genomes, numMuts int, firstTrial int, rng *rand.Rand,
+		results chan interface{})
 }
 
-func loadGenomes(fnames []string) []*Genomes {
+/*
+Load each genome from its GenBank file if there is one, otherwise from its
+.fasta (or .fa) and either a .gff3 or a .orfs file. Any of them can have
+.gz or .bgz on the end. Only the first record of the FASTA file is read
+(see LoadGenome).
+*/
+func loadGenomes(fnames []string) ([]*Genomes, error) {
+	var err error
 	genomes := make([]*Genomes, len(fnames))
 	for i := 0; i < len(fnames); i++ {
-		genomes[i] = LoadGenomes(
-			fnames[i]+".fasta",
-			fnames[i]+".orfs",
-		)
-	}
-	return genomes
-}
+		if gbName := findInput(fnames[i], ".gb"); gbName != "" {
+			genomes[i], err = LoadGenBank(gbName)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// If they're not there we use the plain names so that the error
+		// says what we were looking for
+		orfsName := findInput(fnames[i], ".gff3", ".orfs")
+		if orfsName == "" {
+			orfsName = fnames[i] + ".orfs"
+		}
+		fastaName := findInput(fnames[i], ".fasta", ".fa")
+		if fastaName == "" {
+			fastaName = fnames[i] + ".fasta"
+		}
 
-func findNucDistro(genomes []*Genomes) *NucDistro {
-	nd := NewNucDistro(nil)
-	for i := 0; i < len(genomes); i++ {
-		nd.Count(genomes[i])
+		genomes[i], err = LoadGenome(fastaName, orfsName)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return nd
+	return genomes, nil
 }
 
 /*
 Return an array of ints for how many muts to apply, which either numMuts
 for everything, or the number of silent muts there are between each genome
-and WH1.
+and WH1. The first row of each alignment has to be WH1 (gaps aside) since
+WH1's ORFs are the ones we count with. Alignments that aren't there yet are
+made and saved. If codonAware the ORFs are realigned codon by codon first.
+If nonSilent the non-silent muts are counted too.
 */
-func findMutsPerGenome(fnames []string, numMuts int) []int {
+func findMutsPerGenome(fnames []string, numMuts int,
+	codonAware, nonSilent bool) ([]int, error) {
 	mutsPerGenome := make([]int, len(fnames))
 
-	for i := 0; i < len(fnames); i++ {
-		if numMuts != 0 {
+	if numMuts != 0 {
+		for i := 0; i < len(fnames); i++ {
 			mutsPerGenome[i] = numMuts
+		}
+		return mutsPerGenome, nil
+	}
+
+	wh1, err := LoadGenomes("WH1.fasta", "WH1.orfs")
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(fnames); i++ {
+		genomes, err := LoadWH1Alignment(fnames[i], codonAware)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(ungapped(genomes.nts[0]), wh1.nts[0]) {
+			return nil, fmt.Errorf("WH1-%s.fasta: first row (%s) doesn't "+
+				"match WH1.fasta", fnames[i], genomes.names[0])
+		}
+		silent, nonSilentMuts := CountMutations(genomes)
+		mutsPerGenome[i] = silent
+		if nonSilent {
+			mutsPerGenome[i] += nonSilentMuts
+		}
+	}
+
+	return mutsPerGenome, nil
+}
+
+/*
+Write the main parameters at the top of the results, then every flag as it
+was set (or its default) so you can tell exactly how the run was done. The
+seed is the one we actually used, even if it was picked for you.
+*/
+func writeParams(w io.Writer, nTrials, nMuts, nEdits int, seed int64) {
+	fmt.Fprintf(w, "# Trials: %d Muts: %d (0 means auto) Edits: %d "+
+		"Seed: %d\n", nTrials, nMuts, nEdits, seed)
+
+	flags := make([]string, 0)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if f.Name == "seed" {
+			value = strconv.FormatInt(seed, 10)
+		}
+		if value == "" || strings.ContainsAny(value, " \t") {
+			value = strconv.Quote(value)
+		}
+		flags = append(flags, fmt.Sprintf("-%s=%s", f.Name, value))
+	})
+	fmt.Fprintf(w, "# Flags: %s\n", strings.Join(flags, " "))
+}
+
+/*
+Load each genome and print any problems with its ORFs. Returns true if
+there weren't any.
+*/
+func validateGenomes(fnames []string) bool {
+	ok := true
+	for _, fname := range fnames {
+		genomes, err := loadGenomes([]string{fname})
+		if err != nil {
+			fmt.Println(err)
+			ok = false
+			continue
+		}
+
+		problems := genomes[0].Validate()
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) == 0 {
+			fmt.Printf("%s: OK\n", fname)
 		} else {
-			genomes := LoadGenomes(fmt.Sprintf("WH1-%s.fasta",
-				fnames[i]), "WH1.orfs")
-			mutsPerGenome[i], _ = CountMutations(genomes)
+			ok = false
 		}
 	}
+	return ok
+}
 
-	return mutsPerGenome
+/*
+Fit a Spectrum to the alignments of WH1 with each genome, show it and save
+it to fname so that it can be used with -spectrum.
+*/
+func fitSpectrum(fnames []string, codonAware bool, fname string) error {
+	alignments := make([]*Genomes, len(fnames))
+	for i := 0; i < len(fnames); i++ {
+		var err error
+		alignments[i], err = LoadWH1Alignment(fnames[i], codonAware)
+		if err != nil {
+			return err
+		}
+	}
+
+	spectrum := FitSpectrum(alignments)
+	spectrum.Show()
+	if err := spectrum.Save(fname); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", fname)
+	return nil
+}
+
+/*
+Read an alignment in any format we know and write it out in the one that
+goes with out's extension (see SaveAlignment). "-" means stdin or stdout.
+*/
+func convertAlignment(in, out string) error {
+	fd, err := openInput(in)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	rows, err := readAlignment(bufio.NewReader(fd), in)
+	if err != nil {
+		return err
+	}
+	if len(rows.names) == 0 {
+		return loadError(in, 0, "No sequences")
+	}
+	for i := 1; i < len(rows.nts); i++ {
+		if len(rows.nts[i]) != len(rows.nts[0]) {
+			return loadError(in, rows.lines[i],
+				"%s is length %d but %s is length %d", rows.names[i],
+				len(rows.nts[i]), rows.names[0], len(rows.nts[0]))
+		}
+	}
+
+	g := NewGenomes(nil, 0)
+	g.names, g.nts = rows.names, rows.nts
+	return g.SaveAlignment(out)
+}
+
+/*
+Make a chimera of the parents from a mosaic file and save it as FASTA, with
+a .gff3 file of its ORFs next to it.
+*/
+func recombine(parents *Genomes, mosaicName, fname string) error {
+	mosaic, err := LoadMosaic(mosaicName, parents)
+	if err != nil {
+		return err
+	}
+
+	prefix := strings.TrimSuffix(fname, ".fasta")
+	name := filepath.Base(prefix)
+	chimera := Recombine(parents, mosaic, name)
+	if err := chimera.Save(name, fname, 0); err != nil {
+		return err
+	}
+	err = chimera.orfs.SaveGFF3(prefix+".gff3", name, chimera.Length())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s and %s.gff3\n", fname, prefix)
+	return nil
 }
 
-func writeParams(w io.Writer, nTrials, nMuts, nEdits int) {
-	fmt.Fprintf(w, "# Trials: %d Muts: %d (0 means auto) Edits: %d\n",
-		nTrials, nMuts, nEdits)
+/*
+Make the mutant of genome that the spacing trial with the given seed made
+(see SpacingMutant) and save it as FASTA, with a .gff3 file of its ORFs next
+to it since indels can move them. params and numMuts have to be what they
+were for the trial.
+*/
+func regenerateMutant(genome *Genomes, params *MutationParams, numMuts int,
+	seed int64, fname string) error {
+	mutant, applied := SpacingMutant(genome, params, numMuts, seed)
+
+	w, done, err := CreateFasta(fname, 60)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-mutant-%d", genome.names[0], seed)
+	err = w.Write(name, FastaMetadata{
+		"source":   genome.names[0],
+		"seed":     fmt.Sprintf("%d", seed),
+		"num_muts": fmt.Sprintf("%d", applied),
+	}, mutant.nts[0])
+	if doneErr := done(); err == nil {
+		err = doneErr
+	}
+	if err != nil {
+		return err
+	}
+
+	prefix := strings.TrimSuffix(fname, ".fasta")
+	err = mutant.orfs.SaveGFF3(prefix+".gff3", name, mutant.Length())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s and %s.gff3\n", fname, prefix)
+	return nil
 }
 
 func main() {
-	var nTrials, nMuts, nThreads, nEdits int
-	var test, countSites bool
-	var trialType string
+	var nTrials, nMuts, nThreads, nEdits, codeId int
+	var test, countSites, codonAware bool
+	var trialType, mutantsName, modelName, spectrumName string
+	var signatureName, orfRatesName, siteWeightsName string
+	var orfOmegasName, aaMatrix, treeName, parentsName string
+	var numBreakpoints int
+	var gammaShape, omega, treeScale, indelRate float64
+	var seed int64
+	var indels bool
 
 	flag.IntVar(&nTrials, "n", 10000, "Number of trials")
 	flag.IntVar(&nMuts, "m", 0, "Number of mutations (0 means auto)")
 	flag.IntVar(&nThreads, "p", 1, "Number of threads")
 	flag.BoolVar(&test, "t", false, "Just do some self-tests")
 	flag.BoolVar(&countSites, "c", false, "Count mutations per site etc.")
-	flag.StringVar(&trialType, "trial", "spacing", "Which trials to run")
+	flag.BoolVar(&codonAware, "codon-align", false,
+		"Realign ORFs codon by codon when counting mutations with WH1")
+	flag.StringVar(&modelName, "model", "empirical",
+		"Where replacement nts come from: empirical, codon-position, orf,"+
+			" jc69, k80, hky85, gtr or context")
+	flag.StringVar(&spectrumName, "spectrum", "", "Propose replacements "+
+		"from a spectrum made with fit-spectrum (overrides -model)")
+	flag.StringVar(&signatureName, "signature", "", "Propose replacements "+
+		"from a 96-class signature in COSMIC's format (overrides -model)")
+	flag.Float64Var(&gammaShape, "gamma", 0, "Shape of the gamma "+
+		"distribution of rates at each site (0 means they're all the same)")
+	flag.StringVar(&orfRatesName, "orf-rates", "",
+		"File of rates to multiply each ORF's sites by")
+	flag.StringVar(&siteWeightsName, "site-weights", "",
+		"bedGraph file of weights for each site")
+	flag.Float64Var(&omega, "omega", 0, "Keep non-silent mutations with "+
+		"this dN/dS (0 means only make silent ones)")
+	flag.StringVar(&orfOmegasName, "orf-omegas", "",
+		"File of dN/dS for each ORF, instead of -omega")
+	flag.StringVar(&aaMatrix, "aa-matrix", "", "How readily amino acids "+
+		"change into each other with -omega: grantham or blosum62")
+	flag.BoolVar(&indels, "indels", false, "Make indels as well, like "+
+		"the ones between WH1 and the other genomes")
+	flag.Float64Var(&indelRate, "indel-rate", 0, "Indels per mutation "+
+		"with -indels (0 means as many as between WH1 and the others)")
+	flag.StringVar(&treeName, "tree", "",
+		"Newick file of the tree to simulate down for tree trials")
+	flag.Float64Var(&treeScale, "tree-scale", 0, "Mutations proposed per "+
+		"unit of branch length in tree trials (0 means the genome's length)")
+	flag.StringVar(&parentsName, "parents", "alignment.fasta", "Alignment"+
+		" of the parents of chimeras, with WH1 first, for recombination")
+	flag.IntVar(&numBreakpoints, "breakpoints", 4,
+		"Number of breakpoints in random chimeras")
+	flag.StringVar(&trialType, "trial", "spacing", "Which trials to run: "+
+		"spacing, tamper, tree or recombination")
 	flag.IntVar(&nEdits, "edits", 3, "Number of sites to move")
+	flag.StringVar(&mutantsName, "save-mutants", "",
+		"Save the acceptable mutants from spacing trials to this FASTA file")
+	flag.Int64Var(&seed, "seed", 0, "Seed for the random numbers, so that "+
+		"a run can be repeated (0 means pick one)")
+	flag.IntVar(&codeId, "code", 0, "NCBI genetic code to translate with"+
+		" (0 means whatever the annotations say, or standard)")
 	flag.Parse()
 
 	if test {
@@ -83,6 +340,17 @@ func main() {
 		return
 	}
 
+	// This has to be set before we load anything, so that the alignments
+	// and parents get it too
+	if codeId != 0 {
+		var err error
+		OverrideCode, err = GetGeneticCode(codeId)
+		if err != nil {
+			ShowGeneticCodes()
+			log.Fatal(err)
+		}
+	}
+
 	fnames := []string{
 		"RpYN06",
 		"BtSY2",
@@ -93,32 +361,251 @@ func main() {
 		"RaTG13",
 	}
 
-	genomes := loadGenomes(fnames)
-	nd := findNucDistro(genomes)
-	nd.Show()
+	if flag.Arg(0) == "validate" {
+		if !validateGenomes(fnames) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "convert" {
+		if flag.NArg() != 3 {
+			log.Fatal("Usage: convert <input> <output>")
+		}
+		if err := convertAlignment(flag.Arg(1), flag.Arg(2)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "fit-spectrum" {
+		fname := "spectrum.txt"
+		if flag.NArg() > 1 {
+			fname = flag.Arg(1)
+		}
+		if err := fitSpectrum(fnames, codonAware, fname); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var parents *Genomes
+	if flag.Arg(0) == "recombine" || trialType == "recombination" {
+		var err error
+		parents, err = LoadGenomes(parentsName, "WH1.orfs")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if parents.NumGenomes() < 3 {
+			log.Fatalf("%s needs WH1 and at least two parents", parentsName)
+		}
+	}
 
-	// How many silent muts to apply per genome? If they set 0 that means
+	if flag.Arg(0) == "recombine" {
+		if flag.NArg() != 3 {
+			log.Fatal("Usage: recombine <mosaic file> <output.fasta>")
+		}
+		if err := recombine(parents, flag.Arg(1), flag.Arg(2)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	genomes, err := loadGenomes(fnames)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if indels && (trialType == "tamper" || trialType == "tree" ||
+		countSites) {
+		// These line the mutants up with the original nt by nt
+		log.Fatal("Can't make indels in tamper or tree trials or with -c")
+	}
+
+	// We always need these to tell which of WH1's ORFs each genome's ORFs
+	// are, as well as for fitting some of the models
+	alignments := make([]*Genomes, len(fnames))
+	for i := 0; i < len(fnames); i++ {
+		alignments[i], err = LoadWH1Alignment(fnames[i], false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := genomes[i].MatchOrfs(alignments[i]); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var model NucleotideModel
+	if signatureName != "" {
+		model, err = LoadContextModel(signatureName)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if spectrumName != "" {
+		spectrum, err := LoadSpectrum(spectrumName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		model = NewSpectrumModel(spectrum)
+	} else {
+		model, err = NewNucleotideModel(modelName, genomes, alignments)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	model.Show()
+
+	var orfRates map[string]float64
+	if orfRatesName != "" {
+		orfRates, err = LoadOrfRates(orfRatesName,
+			orfNames(alignments[0], genomes))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var siteWeights map[string][]siteWeight
+	if siteWeightsName != "" {
+		siteWeights, err = LoadSiteWeights(siteWeightsName)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// A track for a genome we haven't got is probably a typo, which
+		// would otherwise mean that genome quietly gets no weights
+		names := make(map[string]bool)
+		for _, g := range genomes {
+			names[g.names[0]] = true
+		}
+		for name := range siteWeights {
+			if !names[name] {
+				fmt.Printf("Warning: %s has weights for %s, which isn't "+
+					"one of the genomes\n", siteWeightsName, name)
+			}
+		}
+	}
+	params := MutationParams{model,
+		NewSiteRates(gammaShape, orfRates, siteWeights), nil, nil}
+
+	if indels {
+		params.indels = FitIndelModel(alignments)
+		if indelRate != 0 {
+			params.indels.silentRate = indelRate
+			params.indels.rate = indelRate
+		}
+		params.indels.Show()
+	}
+
+	if omega != 0 || orfOmegasName != "" {
+		var orfOmegas map[string]float64
+		if orfOmegasName != "" {
+			orfOmegas, err = LoadOrfRates(orfOmegasName,
+				orfNames(alignments[0], genomes))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		params.selection, err = NewSelection(omega, orfOmegas, aaMatrix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		params.selection.Show()
+	}
+
+	// How many muts to apply per genome? If they set 0 that means
 	// "auto" so use the same number as there are between that genome and WH1.
-	mutsPerGenome := findMutsPerGenome(fnames, nMuts)
+	mutsPerGenome, err := findMutsPerGenome(fnames, nMuts, codonAware,
+		params.selection != nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "mutant" {
+		if flag.NArg() != 4 {
+			log.Fatal("Usage: mutant <genome> <seed> <output.fasta>")
+		}
+		if trialType != "spacing" {
+			// The other trials make their mutants differently, and their
+			// seeds wouldn't give you the same ones here
+			log.Fatal("mutant only remakes mutants from spacing trials")
+		}
+		trialSeed, err := strconv.ParseInt(flag.Arg(2), 10, 64)
+		if err != nil {
+			log.Fatalf("Bad seed \"%s\"", flag.Arg(2))
+		}
+		for i, fname := range fnames {
+			if fname != flag.Arg(1) {
+				continue
+			}
+			err := regenerateMutant(genomes[i], &params, mutsPerGenome[i],
+				trialSeed, flag.Arg(3))
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		log.Fatalf("No genome called \"%s\"", flag.Arg(1))
+	}
+
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	fmt.Printf("Seed: %d\n", seed)
 
 	// Construct the trial objects
 	spacingTrial := SpacingTrial{
-		func(genome *Genomes, numMuts int, results chan interface{}) {
-			SpacingTrials(genome, nd, nTrials/nThreads,
-				numMuts, countSites, results)
+		func(genome *Genomes, numMuts int, firstTrial int, rng *rand.Rand,
+			results chan interface{}) {
+			SpacingTrials(genome, &params, firstTrial, nTrials/nThreads,
+				numMuts, countSites, mutantsName != "", rng, results)
 		}}
 
 	tamperTrial := TamperTrial{
-		func(genome *Genomes, numMuts int, results chan interface{}) {
-			TamperTrials(genome, nd, nTrials/nThreads, numMuts, nEdits, results)
+		func(genome *Genomes, numMuts int, firstTrial int, rng *rand.Rand,
+			results chan interface{}) {
+			TamperTrials(genome, &params, nTrials/nThreads, numMuts, nEdits,
+				rng, results)
+		}}
+
+	var tree *TreeNode
+	if trialType == "tree" {
+		if treeName == "" {
+			log.Fatal("Tree trials need a tree (-tree)")
+		}
+		tree, err = LoadNewick(treeName)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	treeTrial := TreeTrial{
+		func(genome *Genomes, numMuts int, firstTrial int, rng *rand.Rand,
+			results chan interface{}) {
+			scale := treeScale
+			if scale == 0 {
+				scale = float64(genome.Length())
+			}
+			TreeTrials(genome, tree, &params, scale, nTrials/nThreads,
+				rng, results)
+		}}
+
+	recombinationTrial := RecombinationTrial{
+		func(genome *Genomes, numMuts int, firstTrial int, rng *rand.Rand,
+			results chan interface{}) {
+			RecombinationTrials(genome, parents, numBreakpoints, &params,
+				nTrials/nThreads, numMuts, rng, results)
 		}}
 
 	trials := map[string]Trial{
-		"spacing": &spacingTrial,
-		"tamper":  &tamperTrial,
+		"spacing":       &spacingTrial,
+		"tamper":        &tamperTrial,
+		"tree":          &treeTrial,
+		"recombination": &recombinationTrial,
 	}
 
-	trial := trials[trialType]
+	trial, there := trials[trialType]
+	if !there {
+		log.Fatalf("Unknown trial type \"%s\"", trialType)
+	}
 
 	fd, err := os.Create("results.txt")
 	if err != nil {
@@ -127,7 +614,7 @@ func main() {
 	defer fd.Close()
 
 	resultsWriter := bufio.NewWriter(fd)
-	writeParams(resultsWriter, nTrials, nMuts, nEdits)
+	writeParams(resultsWriter, nTrials, nMuts, nEdits, seed)
 
 	trial.WriteHeadings(resultsWriter)
 	results := make(chan interface{}, 1000)
@@ -135,7 +622,20 @@ func main() {
 	if trialType == "tamper" {
 		// Write the reference values into the results file
 		for i := 0; i < len(fnames); i++ {
-			CountSilentInSitesReference(fnames[i], RE_SITES, results)
+			err := CountSilentInSitesReference(fnames[i], RE_SITES,
+				codonAware, results)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	var mutantsWriter *FastaWriter
+	var mutantsDone func() error
+	if mutantsName != "" {
+		mutantsWriter, mutantsDone, err = CreateFasta(mutantsName, 60)
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
 
@@ -143,22 +643,28 @@ func main() {
 
 	// Cut the work up unto nThreads pieces, all writing their results to a
 	// single channel. Each thread will do a portion of the tests but for all
-	// genomes
+	// genomes. Each thread has its own random numbers for each genome, which
+	// it gets the seeds for its trials from, so the same -seed and -p give
+	// the same results.
 	for i := 0; i < nThreads; i++ {
 		wg.Add(len(genomes))
 
-		go func() {
+		go func(thread int) {
 			for j := 0; j < len(genomes); j++ {
-				trial.Run(genomes[j], mutsPerGenome[j], results)
+				rng := rand.New(rand.NewSource(deriveSeed(seed,
+					thread*len(genomes)+j)))
+				trial.Run(genomes[j], mutsPerGenome[j],
+					thread*(nTrials/nThreads), rng, results)
 				wg.Done()
 			}
-		}()
+		}(i)
 	}
 
 	// Keep reading out of the results channel and writing to the results file
 	// until everyone has finished (we will write to stop once wg has
 	// completed)
 	stop := make(chan bool)
+	finished := make(chan bool)
 	go func(stop chan bool) {
 	loop:
 		for {
@@ -166,14 +672,38 @@ func main() {
 			case r := <-results:
 				trialResult := r.(TrialResult)
 				trialResult.Write(resultsWriter)
+
+				sr, ok := r.(*SpacingTrialResult)
+				if ok && sr.mutant != nil {
+					err := mutantsWriter.Write(
+						fmt.Sprintf("%s-mutant-%d", sr.name, sr.trial),
+						FastaMetadata{
+							"source":   sr.name,
+							"trial":    fmt.Sprintf("%d", sr.trial),
+							"seed":     fmt.Sprintf("%d", sr.seed),
+							"num_muts": fmt.Sprintf("%d", sr.mutantMuts),
+						}, sr.mutant)
+					if err != nil {
+						log.Fatal(err)
+					}
+				}
 			case <-stop:
 				break loop
 			}
 		}
 		resultsWriter.Flush()
 		fmt.Println("Wrote results.txt")
+
+		if mutantsDone != nil {
+			if err := mutantsDone(); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Wrote %s\n", mutantsName)
+		}
+		finished <- true
 	}(stop)
 
 	wg.Wait()
 	stop <- true
+	<-finished
 }
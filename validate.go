@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Something wrong with a genome or its ORFs
+type Problem struct {
+	name string // Which genome
+	orf  int    // Which ORF (0-based), or -1 if it's not about an ORF
+	pos  int    // 0-based position in the genome it's about
+	what string
+}
+
+func (p Problem) String() string {
+	if p.orf == -1 {
+		return fmt.Sprintf("%s: %s", p.name, p.what)
+	}
+	return fmt.Sprintf("%s: ORF %d at %d: %s", p.name, p.orf+1, p.pos+1,
+		p.what)
+}
+
+/*
+Check that the ORFs make sense for the first genome: that they're inside
+it, are a whole number of codons, start with ATG (or another start codon
+their genetic code allows), end with a stop, and don't have any stops
+before that. Returns all the problems we found, so an empty list means it's
+all OK. The positions in them are in the first genome, not the alignment.
+*/
+func (g *Genomes) Validate() []Problem {
+	ret := make([]Problem, 0)
+	if len(g.orfs) == 0 {
+		ret = append(ret, Problem{g.names[0], -1, 0, "No ORFs"})
+	}
+	for i := range g.orfs {
+		ret = append(ret, g.ValidateOrf(i)...)
+	}
+	return ret
+}
+
+// The problems with ORF i (see Validate)
+func (g *Genomes) ValidateOrf(i int) []Problem {
+	ret := make([]Problem, 0)
+	name := g.names[0]
+	nts := g.nts[0]
+	liftover := g.Liftover(0)
+
+	problem := func(col int, format string, args ...interface{}) {
+		pos := col
+		if col >= 0 && col < len(nts) {
+			pos = liftover.PositionAtOrAfter(col)
+		}
+		ret = append(ret, Problem{name, i, pos, fmt.Sprintf(format,
+			args...)})
+	}
+
+	orf := &g.orfs[i]
+	for _, seg := range orf.segments {
+		if seg.start < 0 || seg.end > len(nts) || seg.start >= seg.end {
+			problem(seg.start, "Segment %d-%d isn't inside the "+
+				"genome (length %d)", seg.start+1, seg.end, len(nts))
+			return ret
+		}
+	}
+
+	length := orf.Length()
+	if length%3 != 0 {
+		problem(orf.PosAt(0), "Length %d isn't a multiple of 3", length)
+	}
+
+	codon := make([]byte, 3)
+	for j := 0; j+3 <= length; j += 3 {
+		for k := 0; k < 3; k++ {
+			codon[k] = nts[orf.PosAt(j+k)]
+			if orf.reverse {
+				codon[k] = complement(codon[k])
+			}
+		}
+		aa := orf.code.Translate(codon)
+		pos := orf.PosAt(j)
+
+		switch {
+		case j == 0:
+			if string(codon) != "ATG" && !orf.code.IsStart(codon) {
+				problem(pos, "Starts with %s not ATG", string(codon))
+			}
+		case j+3 > length-3:
+			if aa != '*' {
+				problem(pos, "Ends with %s which isn't a stop",
+					string(codon))
+			}
+		case aa == '*':
+			problem(pos, "Internal stop %s", string(codon))
+		}
+	}
+
+	return ret
+}